@@ -0,0 +1,929 @@
+// Package app is the helm viv command.
+//
+// It is importable so that custom helm-viv binaries can add their own functions to vivs:
+//
+//	func main() {
+//		app.Execute(template.FuncMap{"myFunc": myFunc})
+//	}
+package app
+
+import (
+	"fmt"
+	"github.com/lazychanger/helm-variable-in-values/cmd/helm-variable-in-values/utils"
+	"github.com/lazychanger/helm-variable-in-values/common"
+	vivEngine "github.com/lazychanger/helm-variable-in-values/pkg/engine"
+	"github.com/lazychanger/helm-variable-in-values/pkg/logger"
+	pkgUtils "github.com/lazychanger/helm-variable-in-values/pkg/utils"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"helm.sh/helm/v3/pkg/registry"
+
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/cli/values"
+	"helm.sh/helm/v3/pkg/downloader"
+	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/helmpath"
+	kubefake "helm.sh/helm/v3/pkg/kube/fake"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/storage/driver"
+
+	"io"
+	"io/ioutil"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/rest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime/debug"
+	"sigs.k8s.io/yaml"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var (
+	usage = `Helm plugin to use variable in values
+
+Examples:
+  $ helm viv install releaseName repo/chart -n namespace   
+  $ helm viv upgrade releaseName repo/chart -n namespace  
+  $ helm viv diff upgrade releaseName repo/chart -n namespace
+  $ helm viv render repo/chart --output-dir ./values [--merged]
+  $ helm viv test ./chart [--update]
+  $ helm viv package [release] ./chart -f ./values.yaml [--destination ./dist]
+  $ helm viv cache clean
+  $ helm viv clean ./chart
+`
+	settings     = cli.New()
+	cliFlags     = new(utils.Flags)
+	actionConfig = new(action.Configuration)
+	version      = common.GetVersion()
+	helmbin      = "helm"
+	envAllow     []string
+	extraFuncs   = template.FuncMap{}
+	vivLog       = logger.Default()
+)
+
+// vivFlagPrefix is the prefix of the flags handled by viv, they are not passed to helm
+const vivFlagPrefix = "viv-"
+
+// vivBoolFlags are the viv flags that do not take a value
+var vivBoolFlags = []string{"viv-deterministic", "viv-forbid-nondeterministic", "viv-in-process", "viv-lookup", "viv-no-cache", "viv-strict"}
+
+// helmBoolFlags are the helm flags, and the flags of viv commands, that do not take a value
+var helmBoolFlags = []string{
+	"g", "generate-name", "dry-run", "debug", "atomic", "wait", "wait-for-jobs", "no-hooks", "replace", "devel",
+	"dependency-update", "disable-openapi-validation", "create-namespace", "skip-crds", "verify",
+	"insecure-skip-tls-verify", "pass-credentials", "render-subchart-notes", "include-crds", "validate",
+	"is-upgrade", "release-name", "i", "install", "reuse-values", "reset-values", "force", "cleanup-on-fail",
+	"strict", "with-subcharts", "quiet", "enable-dns", "kube-insecure-skip-tls-verify", "h", "help",
+	"skip-tests", "merged", "update",
+	// helm diff upgrade
+	"allow-unreleased", "suppress-secrets", "show-secrets", "three-way-merge", "detailed-exitcode", "no-color", "color",
+	"normalize-manifests", "include-tests", "disable-validation", "strip-trailing-cr",
+}
+
+// boolFlags are all the flags that do not take a value
+func boolFlags() []string {
+	return append(append([]string{}, helmBoolFlags...), vivBoolFlags...)
+}
+
+func init() {
+	cliFlags = utils.ParseFlags(os.Args, boolFlags()...)
+	settings.Debug = utils.BoolDefaultValue(cliFlags.GetBool("debug"), settings.Debug)
+	if err := initLogger(); err != nil {
+		vivLog.Error(err.Error())
+		lc.exit(exitError)
+	}
+	settings.SetNamespace(utils.StringDefaultValue(cliFlags.GetString("n", "namespace"), settings.Namespace()))
+	settings.KubeConfig = utils.StringDefaultValue(cliFlags.GetString("kubeconfig"), settings.KubeConfig)
+	settings.KubeContext = utils.StringDefaultValue(cliFlags.GetString("kube-context"), settings.KubeContext)
+	settings.KubeToken = utils.StringDefaultValue(cliFlags.GetString("kube-token"), settings.KubeToken)
+	settings.KubeAsUser = utils.StringDefaultValue(cliFlags.GetString("kube-as-user"), settings.KubeAsUser)
+	settings.KubeAsGroups = utils.StringSliceDefaultValue(cliFlags.GetStringSlice("kube-as-groups"), settings.KubeAsGroups)
+	settings.KubeAPIServer = utils.StringDefaultValue(cliFlags.GetString("kube-apiserver"), settings.KubeAPIServer)
+	settings.KubeCaFile = utils.StringDefaultValue(cliFlags.GetString("kube-ca-file"), settings.KubeCaFile)
+	settings.KubeTLSServerName = utils.StringDefaultValue(cliFlags.GetString("kube-tls-server-name"), settings.KubeTLSServerName)
+	settings.KubeInsecureSkipTLSVerify = utils.BoolDefaultValue(cliFlags.GetBool("kube-insecure-skip-tls-verify"), settings.KubeInsecureSkipTLSVerify)
+	settings.RegistryConfig = utils.StringDefaultValue(cliFlags.GetString("registry-config"), settings.RegistryConfig)
+	settings.RepositoryCache = utils.StringDefaultValue(cliFlags.GetString("repository-cache"), settings.RepositoryCache)
+	settings.BurstLimit = utils.IntDefaultValue(cliFlags.GetInt("burst-limit"), settings.BurstLimit)
+	settings.RepositoryConfig = utils.StringDefaultValue(cliFlags.GetString("repository-config"), settings.RepositoryConfig)
+
+	envAllow = utils.SplitList(append(cliFlags.GetStringSlice("viv-env-allow"), os.Getenv("HELM_VIV_ENV_ALLOW"))...)
+
+	_helmbin := os.Getenv("HELM_VIV_HELMBIN")
+	if _helmbin != "" {
+		helmbin = _helmbin
+	}
+}
+
+// Execute runs helm viv and exits. funcs are added to the functions of every viv.
+func Execute(funcs ...template.FuncMap) {
+	for _, fm := range funcs {
+		for name, fn := range fm {
+			extraFuncs[name] = fn
+		}
+	}
+
+	lc.handleSignals()
+
+	// run when each command's execute method is called
+	cobra.OnInitialize(func() {
+		helmDriver := os.Getenv("HELM_DRIVER")
+		if err := actionConfig.Init(settings.RESTClientGetter(), settings.Namespace(), helmDriver, vivLog.Debugf); err != nil {
+			vivLog.Error(err.Error())
+			lc.exit(exitError)
+		}
+		if helmDriver == "memory" {
+			loadReleasesInMemory(actionConfig)
+		}
+	})
+
+	if err := (&cobra.Command{
+		Use:          "helm viv",
+		Short:        "Helm plugin to use variable in values",
+		Long:         usage,
+		SilenceUsage: false,
+		// errors are logged once, in the log format
+		SilenceErrors:      true,
+		DisableFlagParsing: true,
+		Version:            version.Version,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				return cmd.Usage()
+			}
+			switch args[0] {
+			case "help":
+				return cmd.Help()
+			case "version":
+				return pkgUtils.Tmpl(cmd.OutOrStdout(), cmd.VersionTemplate(), map[string]string{
+					"Name":    cmd.Name(),
+					"Version": cmd.Version,
+				})
+			case "cache":
+				if len(args) > 1 && args[1] == "clean" {
+					return cleanCache(cmd.OutOrStdout())
+				}
+				return errors.New("unknown cache command, usage: helm viv cache clean")
+			case "clean":
+				return cleanWorkspaces(cmd.OutOrStdout(), args)
+			case "render":
+				return renderValues(cmd.OutOrStdout(), args)
+			case "test":
+				return testVivs(cmd.OutOrStdout(), args)
+			case "package":
+				return packageChart(cmd.OutOrStdout(), args)
+			case postRenderCommand:
+				return postRender(os.Stdin, cmd.OutOrStdout(), args[1:])
+			case "diff":
+				// helm-diff plugin, only `helm diff upgrade` renders a chart
+				if len(args) < 2 || args[1] != "upgrade" {
+					break
+				}
+				fallthrough
+			case "install", "upgrade", "lint", "template":
+				b, err := buildVIVEngine(args)
+				if err != nil {
+					return err
+				}
+				if args[0] == "install" && len(chartArgs(args)) == 1 {
+					// vivs are rendered with the generated name, helm must not generate another one
+					args = withReleaseName(args, b.releaseName)
+				}
+
+				if !settings.Debug {
+					lc.onExit(b.Clear)
+				}
+				vivFiles, err := renderToTemp(b)
+				if err != nil {
+					return err
+				}
+				if read := b.EnvRead(); len(read) > 0 {
+					vivLog.Info("viv env read", "vars", strings.Join(read, ", "))
+				}
+
+				if inProcess(args[0]) {
+					return runInProcess(cmd.OutOrStdout(), args[0], b, vivFiles)
+				}
+				for _, f := range vivFiles {
+					args = append(args, "-f", f)
+				}
+				if args[0] != "lint" {
+					patches, err := b.RenderPatchesToTemp()
+					if err != nil {
+						return renderFailed(err)
+					}
+					if patches != "" {
+						if args, err = withPostRenderer(args, patches); err != nil {
+							return err
+						}
+					}
+				}
+
+				break
+			}
+
+			return proxyHelmCmd(utils.RemoveFlags(args, vivFlagPrefix, vivBoolFlags...))
+		},
+	}).Execute(); err != nil {
+		if isHelmExit(err) {
+			vivLog.Debug("helm failed", "err", err)
+		} else {
+			vivLog.Error(err.Error())
+		}
+		lc.exit(exitCode(err))
+	}
+	lc.cleanup()
+}
+
+// renderToTemp renders the vivs to the output dir, RenderToTemp panics on errors
+func renderToTemp(b *vivBuild) (files []string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if err, _ = r.(error); err == nil {
+				err = errors.Errorf("%v", r)
+			}
+			err = renderFailed(err)
+		}
+	}()
+	return b.RenderToTemp(), nil
+}
+
+// vivBuild is the viv engine of the chart of a helm command
+type vivBuild struct {
+	*vivEngine.Engine
+
+	releaseName string
+	// chartPath is the chart on disk, a directory or an archive
+	chartPath string
+}
+
+// buildVIVEngine returns the engine of the chart of the helm command
+func buildVIVEngine(args []string) (*vivBuild, error) {
+	registryClient, err := registry.NewClient(
+		registry.ClientOptDebug(settings.Debug),
+		registry.ClientOptEnableCache(true),
+		registry.ClientOptWriter(os.Stdout),
+		registry.ClientOptCredentialsFile(settings.RegistryConfig),
+	)
+
+	if err != nil {
+		return nil, err
+	}
+	actionConfig.RegistryClient = registryClient
+
+	client := action.NewInstall(actionConfig)
+	client.DryRun = true
+	// like helm, install names the release from --name-template or --generate-name, other commands default to release-name
+	client.ReleaseName = pkgUtils.IF(args[0] == "install", "", "release-name")
+	client.GenerateName = cliFlags.GetBool("generate-name") || cliFlags.GetBool("g")
+	client.NameTemplate = cliFlags.GetString("name-template")
+	client.Replace = true // Skip the name check
+	client.ClientOnly = false
+	client.APIVersions = chartutil.VersionSet(nil)
+	client.IncludeCRDs = false
+
+	// missing dependencies are downloaded before the vivs render, helm finds them in place
+	client.DependencyUpdate = cliFlags.GetBool("dependency-update")
+
+	client.ChartPathOptions.Version = utils.StringDefaultValue(cliFlags.GetString("version"), client.ChartPathOptions.Version)
+	client.ChartPathOptions.Verify = utils.BoolDefaultValue(cliFlags.GetBool("verify"), client.ChartPathOptions.Verify)
+	client.ChartPathOptions.Keyring = utils.StringDefaultValue(cliFlags.GetString("keyring"), client.ChartPathOptions.Keyring)
+	client.ChartPathOptions.RepoURL = utils.StringDefaultValue(cliFlags.GetString("repo-url"), client.ChartPathOptions.RepoURL)
+	client.ChartPathOptions.Username = utils.StringDefaultValue(cliFlags.GetString("username"), client.ChartPathOptions.Username)
+	client.ChartPathOptions.Password = utils.StringDefaultValue(cliFlags.GetString("password"), client.ChartPathOptions.Password)
+	client.ChartPathOptions.CertFile = utils.StringDefaultValue(cliFlags.GetString("cert-file"), client.ChartPathOptions.CertFile)
+	client.ChartPathOptions.KeyFile = utils.StringDefaultValue(cliFlags.GetString("key-file"), client.ChartPathOptions.KeyFile)
+	client.ChartPathOptions.InsecureSkipTLSverify = utils.BoolDefaultValue(cliFlags.GetBool("insecure-skip-tls-verify"), client.ChartPathOptions.InsecureSkipTLSverify)
+	client.ChartPathOptions.KeyFile = utils.StringDefaultValue(cliFlags.GetString("key-file"), client.ChartPathOptions.KeyFile)
+	client.ChartPathOptions.CaFile = utils.StringDefaultValue(cliFlags.GetString("ca-file"), client.ChartPathOptions.CaFile)
+	client.ChartPathOptions.PassCredentialsAll = utils.BoolDefaultValue(cliFlags.GetBool("pass-credentials"), client.ChartPathOptions.PassCredentialsAll)
+
+	valueOpts := valueOptions()
+
+	settingsOverride, err := vivSettings()
+	if err != nil {
+		return nil, err
+	}
+
+	chartRequested, workdir, err := buildChart(chartArgs(args), client, os.Stdout)
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := buildValuesRender(args[0], chartRequested, client, valueOpts, actionConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	restConfig, err := lookupRESTConfig(args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	var lookup func(apiVersion, kind, namespace, name string) (map[string]interface{}, error)
+	if fixtures := cliFlags.GetString("viv-lookup-fixtures"); fixtures != "" {
+		f, err := vivEngine.LoadLookupFixtures(fixtures)
+		if err != nil {
+			return nil, err
+		}
+		lookup = f.Lookup
+	}
+
+	e := vivEngine.NewEngine(&vivEngine.Config{
+		WorkDir: strings.TrimRight(workdir, "/"),
+		Values:  values,
+		Chart:   chartRequested,
+		Logger:  vivLog,
+
+		EnvAllow: envAllow,
+		Funcs:    extraFuncs,
+
+		Deterministic:          cliFlags.GetBool("viv-deterministic"),
+		ForbidNondeterministic: cliFlags.GetBool("viv-forbid-nondeterministic"),
+		Now:                    sourceDateEpoch(),
+
+		RESTConfig: restConfig,
+		Lookup:     lookup,
+
+		Env:      cliFlags.GetString("viv-env"),
+		Settings: settingsOverride,
+
+		CacheDir:     cacheDir(),
+		BuildVersion: buildVersion(),
+		Concurrency:  utils.IntDefaultValue(cliFlags.GetInt("viv-concurrency"), 1),
+	})
+
+	return &vivBuild{Engine: e, releaseName: client.ReleaseName, chartPath: workdir}, nil
+}
+
+// valueOptions are the values flags of the helm command
+func valueOptions() *values.Options {
+	valueOpts := &values.Options{}
+	valueOpts.ValueFiles = cliFlags.GetStringSlice("f", "values")
+	valueOpts.Values = cliFlags.GetStringSlice("set")
+	valueOpts.FileValues = cliFlags.GetStringSlice("set-file")
+	valueOpts.StringValues = cliFlags.GetStringSlice("set-string")
+	valueOpts.JSONValues = cliFlags.GetStringSlice("set-json")
+	return valueOpts
+}
+
+// renderValues writes the values rendered by the vivs to --output-dir, with a manifest.
+// The release name is optional, like for helm template.
+func renderValues(out io.Writer, args []string) error {
+	dir := cliFlags.GetString("output-dir")
+	if dir == "" {
+		return errors.New("--output-dir is required, usage: helm viv render [NAME] CHART --output-dir DIR [--merged]")
+	}
+	if len(chartArgs(args)) == 1 {
+		args = append([]string{args[0], "release-name"}, args[1:]...)
+	}
+
+	e, err := buildVIVEngine(args)
+	if err != nil {
+		return err
+	}
+	manifest, err := e.Export(dir, cliFlags.GetBool("merged"))
+	if err != nil {
+		return renderFailed(err)
+	}
+
+	for _, f := range manifest.Files {
+		fmt.Fprintf(out, "wrote %s\n", filepath.Join(dir, f.Path))
+	}
+	_, err = fmt.Fprintf(out, "wrote %s\n", filepath.Join(dir, vivEngine.ManifestName))
+	return err
+}
+
+// packageChart packages the chart with the values rendered by the vivs baked into values.yaml.
+// The release name and namespace are optional, like for helm template.
+func packageChart(out io.Writer, args []string) error {
+	named := len(chartArgs(args)) > 1
+	namespaced := cliFlags.GetString("n", "namespace") != ""
+	if !named {
+		args = append([]string{args[0], unsetReleaseName}, args[1:]...)
+	}
+
+	e, err := buildVIVEngine(args)
+	if err != nil {
+		return err
+	}
+	if !named || !namespaced {
+		if err := checkReleaseUnused(e, args, named); err != nil {
+			return renderFailed(err)
+		}
+	}
+	archive, err := e.Package(utils.StringDefaultValue(cliFlags.GetString("d", "destination"), "."))
+	if err != nil {
+		return renderFailed(err)
+	}
+	_, err = fmt.Fprintf(out, "Successfully packaged chart and saved it to: %s\n", archive)
+	return err
+}
+
+const (
+	// unsetReleaseName is the release name of the vivs packaged without one
+	unsetReleaseName = "viv-unset-release-name"
+	// otherReleaseName and otherNamespace render the vivs again, to find the values that depend on them
+	otherReleaseName = "viv-other-release-name"
+	otherNamespace   = "viv-other-namespace"
+)
+
+// checkReleaseUnused fails when the values packaged without a release name or namespace depend on them,
+// they would not match the release the chart is installed as. The vivs are rendered again with other ones,
+// the values that also change when the vivs are rendered again as they are, e.g. random values, are ignored.
+func checkReleaseUnused(e *vivBuild, args []string, named bool) error {
+	baked, err := e.BakedValues(true)
+	if err != nil {
+		return err
+	}
+
+	otherArgs := args
+	if !named {
+		otherArgs = append([]string{args[0], otherReleaseName}, args[2:]...)
+	}
+	namespace := settings.Namespace()
+	if cliFlags.GetString("n", "namespace") == "" {
+		settings.SetNamespace(otherNamespace)
+	}
+	other, err := buildVIVEngine(otherArgs)
+	settings.SetNamespace(namespace)
+	if err != nil {
+		return err
+	}
+	otherBaked, err := other.BakedValues(true)
+	if err != nil {
+		return err
+	}
+
+	changed := changedKeys("", baked, otherBaked)
+	if len(changed) == 0 {
+		return nil
+	}
+	again, err := e.BakedValues(false)
+	if err != nil {
+		return err
+	}
+	unstable := map[string]bool{}
+	for _, k := range changedKeys("", baked, again) {
+		unstable[k] = true
+	}
+	dependent := make([]string, 0, len(changed))
+	for _, k := range changed {
+		if !unstable[k] {
+			dependent = append(dependent, k)
+		}
+	}
+	if len(dependent) > 0 {
+		return errors.Errorf("the values %s depend on the release name or namespace, package with them: helm viv package -n NAMESPACE RELEASE CHART", strings.Join(dependent, ", "))
+	}
+	return nil
+}
+
+// changedKeys returns the paths of the keys whose values differ between a and b, sorted
+func changedKeys(prefix string, a, b map[string]interface{}) []string {
+	keys := make([]string, 0)
+	for k, v := range a {
+		key := strings.TrimPrefix(prefix+"."+k, ".")
+		av, aok := v.(map[string]interface{})
+		bv, bok := b[k].(map[string]interface{})
+		if aok && bok {
+			keys = append(keys, changedKeys(key, av, bv)...)
+			continue
+		}
+		if _, ok := b[k]; !ok || !reflect.DeepEqual(v, b[k]) {
+			keys = append(keys, key)
+		}
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, strings.TrimPrefix(prefix+"."+k, "."))
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// testVivs runs the test cases of the vivs of a local chart, see vivEngine.RunTests
+func testVivs(out io.Writer, args []string) error {
+	chartDir := "."
+	if positional := chartArgs(args); len(positional) > 0 {
+		chartDir = positional[0]
+	}
+
+	settings, err := vivSettings()
+	if err != nil {
+		return err
+	}
+	results, err := vivEngine.RunTests(chartDir, vivEngine.TestOptions{
+		Update:   cliFlags.GetBool("update"),
+		Funcs:    extraFuncs,
+		Settings: settings,
+	})
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, r := range results {
+		switch {
+		case r.Updated:
+			fmt.Fprintf(out, "UPDATED %s\n", r.Name)
+		case r.Passed():
+			fmt.Fprintf(out, "PASS    %s\n", r.Name)
+		default:
+			failed++
+			fmt.Fprintf(out, "FAIL    %s\n", r.Name)
+			for _, f := range r.Failures {
+				fmt.Fprintf(out, "        %s\n", strings.ReplaceAll(f, "\n", "\n        "))
+			}
+		}
+	}
+	if failed > 0 {
+		return errors.Errorf("%d of %d viv tests failed", failed, len(results))
+	}
+	fmt.Fprintf(out, "%d viv tests passed\n", len(results))
+	return nil
+}
+
+// vivSettings are the viv settings of the charts overridden with flags, or HELM_VIV_* variables
+func vivSettings() (vivEngine.Settings, error) {
+	s := vivEngine.Settings{
+		VivDir:     utils.StringDefaultValue(cliFlags.GetString("viv-dir"), os.Getenv("HELM_VIV_DIR")),
+		OutputDir:  utils.StringDefaultValue(cliFlags.GetString("viv-output-dir"), os.Getenv("HELM_VIV_OUTPUT_DIR")),
+		Precedence: utils.StringDefaultValue(cliFlags.GetString("viv-precedence"), os.Getenv("HELM_VIV_PRECEDENCE")),
+	}
+
+	if cliFlags.Has("viv-strict") {
+		strict := cliFlags.GetBool("viv-strict")
+		s.Strict = &strict
+	} else if env := os.Getenv("HELM_VIV_STRICT"); env != "" {
+		strict, err := strconv.ParseBool(env)
+		if err != nil {
+			return s, errors.Wrap(err, "HELM_VIV_STRICT")
+		}
+		s.Strict = &strict
+	}
+	return s, nil
+}
+
+// lookupRESTConfig returns the cluster config for `lookup` in vivs.
+// install and upgrade read from the cluster, other commands only with --viv-lookup.
+func lookupRESTConfig(command string) (*rest.Config, error) {
+	switch {
+	case cliFlags.GetString("viv-lookup-fixtures") != "":
+		return nil, nil
+	case command == "install", command == "upgrade", cliFlags.GetBool("viv-lookup"):
+		return settings.RESTClientGetter().ToRESTConfig()
+	}
+	return nil, nil
+}
+
+// sourceDateEpoch is the time of `now` in deterministic mode, SOURCE_DATE_EPOCH or the unix epoch
+func sourceDateEpoch() time.Time {
+	epoch, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64)
+	if err != nil {
+		return time.Unix(0, 0)
+	}
+	return time.Unix(epoch, 0)
+}
+
+func loadReleasesInMemory(actionConfig *action.Configuration) {
+	filePaths := strings.Split(os.Getenv("HELM_MEMORY_DRIVER_DATA"), ":")
+	if len(filePaths) == 0 {
+		return
+	}
+
+	store := actionConfig.Releases
+	mem, ok := store.Driver.(*driver.Memory)
+	if !ok {
+		// For an unexpected reason we are not dealing with the memory storage driver.
+		return
+	}
+
+	actionConfig.KubeClient = &kubefake.PrintingKubeClient{Out: io.Discard}
+
+	for _, path := range filePaths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			vivLog.Error("Unable to read memory driver data", "err", err)
+			lc.exit(exitError)
+		}
+
+		releases := []*release.Release{}
+		if err := yaml.Unmarshal(b, &releases); err != nil {
+			vivLog.Error("Unable to unmarshal memory driver data", "err", err)
+			lc.exit(exitError)
+		}
+
+		for _, rel := range releases {
+			if err := store.Create(rel); err != nil {
+				vivLog.Error(err.Error())
+				lc.exit(exitError)
+			}
+		}
+	}
+	// Must reset namespace to the proper one
+	mem.SetNamespace(settings.Namespace())
+}
+
+// chartArgs returns the positional arguments of the helm command, e.g. [release chart]
+func chartArgs(args []string) []string {
+	if args[0] == "diff" {
+		return utils.Positionals(args[2:], boolFlags()...)
+	}
+	return utils.Positionals(args[1:], boolFlags()...)
+}
+
+// withReleaseName replaces --generate-name and --name-template of helm install with the release name
+func withReleaseName(args []string, name string) []string {
+	out := []string{args[0], name}
+	skipValue := false
+	for _, arg := range args[1:] {
+		if skipValue {
+			skipValue = false
+			continue
+		}
+		switch {
+		case arg == "--generate-name", arg == "-g", strings.HasPrefix(arg, "--generate-name="), strings.HasPrefix(arg, "--name-template="):
+			continue
+		case arg == "--name-template":
+			skipValue = true
+			continue
+		}
+		out = append(out, arg)
+	}
+	return out
+}
+
+// cacheDir is where viv outputs are cached, empty with --viv-no-cache
+func cacheDir() string {
+	if cliFlags.GetBool("viv-no-cache") {
+		return ""
+	}
+	return helmpath.CachePath("viv")
+}
+
+// buildVersion identifies the build for the cache: the version and git commit set at link time,
+// or the VCS revision go build records, so that builds outside the Makefile do not share outputs
+func buildVersion() string {
+	commit := version.GitCommit
+	if info, ok := debug.ReadBuildInfo(); ok && commit == "" {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" || s.Key == "vcs.modified" {
+				commit += s.Value
+			}
+		}
+	}
+	return version.Version + "+" + commit
+}
+
+func cleanCache(out io.Writer) error {
+	dir := helmpath.CachePath("viv")
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(out, "removed %s\n", dir)
+	return err
+}
+
+// cleanWorkspaces removes the workspaces left by crashed runs in the output dir of a local chart
+func cleanWorkspaces(out io.Writer, args []string) error {
+	chartDir := "."
+	if positional := chartArgs(args); len(positional) > 0 {
+		chartDir = positional[0]
+	}
+
+	settingsOverride, err := vivSettings()
+	if err != nil {
+		return err
+	}
+	ch, err := loader.Load(chartDir)
+	if err != nil {
+		return err
+	}
+	removed, err := vivEngine.NewEngine(&vivEngine.Config{
+		WorkDir:  chartDir,
+		Chart:    ch,
+		Settings: settingsOverride,
+		Logger:   vivLog,
+	}).CleanWorkspaces()
+	if err != nil {
+		return err
+	}
+
+	for _, ws := range removed {
+		fmt.Fprintf(out, "removed %s\n", ws)
+	}
+	_, err = fmt.Fprintf(out, "removed %d stale workspace(s)\n", len(removed))
+	return err
+}
+
+func proxyHelmCmd(args []string) error {
+
+	vivLog.Debug("exec", "helm", helmbin, "args", strings.Join(utils.RedactArgs(args, boolFlags()...), " "))
+	cmd := exec.Command(helmbin, args...)
+	cmd.Env = os.Environ()
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Stdin = os.Stdin
+
+	return lc.run(cmd)
+}
+
+// initLogger sets the logger from --viv-log-level and --viv-log-format, or HELM_VIV_LOG_LEVEL and HELM_VIV_LOG_FORMAT.
+// It logs warnings and errors by default, everything with --debug.
+func initLogger() error {
+	level := logger.LevelWarn
+	if settings.Debug {
+		level = logger.LevelDebug
+	}
+	if name := utils.StringDefaultValue(cliFlags.GetString("viv-log-level"), os.Getenv("HELM_VIV_LOG_LEVEL")); name != "" {
+		var err error
+		if level, err = logger.ParseLevel(name); err != nil {
+			return err
+		}
+	}
+
+	l, err := logger.New(os.Stderr, level, utils.StringDefaultValue(cliFlags.GetString("viv-log-format"), os.Getenv("HELM_VIV_LOG_FORMAT")))
+	if err != nil {
+		return err
+	}
+	logger.SetDefault(l)
+	vivLog = l
+	return nil
+}
+
+func buildChart(args []string, client *action.Install, out io.Writer) (*chart.Chart, string, error) {
+
+	name, chart, err := client.NameAndChart(args)
+	if err != nil {
+		return nil, "", err
+	}
+	client.ReleaseName = name
+
+	cp, err := client.ChartPathOptions.LocateChart(chart, settings)
+	if err != nil {
+		return nil, "", err
+	}
+
+	vivLog.Debug("chart path", "path", cp)
+	chartRequested, err := loader.Load(cp)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := checkIfInstallable(chartRequested); err != nil {
+		return nil, "", err
+	}
+
+	if chartRequested.Metadata.Deprecated {
+		vivLog.Warn("This chart is deprecated")
+	}
+
+	if req := chartRequested.Metadata.Dependencies; req != nil {
+		// If CheckDependencies returns an error, we have unfulfilled dependencies.
+		// As of Helm 2.4.0, this is treated as a stopping condition:
+		// https://github.com/helm/helm/issues/2209
+		if err := action.CheckDependencies(chartRequested, req); err != nil {
+			err = errors.Wrap(err, "An error occurred while checking for chart dependencies. You may need to run `helm dependency build` to fetch missing dependencies")
+			if client.DependencyUpdate {
+				man := &downloader.Manager{
+					Out:              out,
+					ChartPath:        cp,
+					Keyring:          client.ChartPathOptions.Keyring,
+					SkipUpdate:       false,
+					Getters:          getter.All(settings),
+					RepositoryConfig: settings.RepositoryConfig,
+					RepositoryCache:  settings.RepositoryCache,
+					Debug:            settings.Debug,
+				}
+				if err := man.Update(); err != nil {
+					return nil, "", err
+				}
+				// Reload the chart with the updated Chart.lock file.
+				if chartRequested, err = loader.Load(cp); err != nil {
+					return nil, "", errors.Wrap(err, "failed reloading chart after repo update")
+				}
+
+				return chartRequested, cp, nil
+			} else {
+				return nil, "", err
+			}
+		}
+	}
+
+	return chartRequested, cp, nil
+}
+
+func buildValuesRender(command string, chartRequested *chart.Chart, client *action.Install, valueOpts *values.Options, cfg *action.Configuration) (chartutil.Values, error) {
+	vivLog.Debugf("Original chart version: %q", client.Version)
+	if client.Version == "" && client.Devel {
+		vivLog.Debugf("setting version to >0.0.0-0")
+		client.Version = ">0.0.0-0"
+	}
+
+	p := getter.All(settings)
+	vals, err := valueOpts.MergeValues(p)
+	if err != nil {
+		return nil, err
+	}
+
+	client.Namespace = settings.Namespace()
+
+	if err := chartutil.ProcessDependencies(chartRequested, vals); err != nil {
+		return nil, err
+	}
+
+	isUpgrade := client.IsUpgrade && client.DryRun
+
+	options := chartutil.ReleaseOptions{
+		Name:      client.ReleaseName,
+		Namespace: client.Namespace,
+		Revision:  1,
+		IsInstall: !isUpgrade,
+		IsUpgrade: isUpgrade,
+	}
+	caps, err := cachedCapabilities(cfg, command)
+	if err != nil {
+		return nil, err
+	}
+
+	return chartutil.ToRenderValues(chartRequested, vals, options, caps)
+}
+
+func GetCapabilities(cfg *action.Configuration) (*chartutil.Capabilities, error) {
+	if cfg.Capabilities != nil {
+		return cfg.Capabilities, nil
+	}
+	dc, err := cfg.RESTClientGetter.ToDiscoveryClient()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get Kubernetes discovery client")
+	}
+	// force a discovery cache invalidation to always fetch the latest server version/capabilities.
+	dc.Invalidate()
+	kubeVersion, err := dc.ServerVersion()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get server version from Kubernetes")
+	}
+	// Issue #6361:
+	// Client-Go emits an error when an API service is registered but unimplemented.
+	// We trap that error here and print a warning. But since the discovery client continues
+	// building the API object, it is correctly populated with all valid APIs.
+	// See https://github.com/kubernetes/kubernetes/issues/72051#issuecomment-521157642
+	apiVersions, err := action.GetVersionSet(dc)
+	if err != nil {
+		if discovery.IsGroupDiscoveryFailedError(err) {
+			cfg.Log("WARNING: The Kubernetes server has an orphaned API service. Server reports: %s", err)
+			cfg.Log("WARNING: To fix this, kubectl delete apiservice <service-name>")
+		} else {
+			return nil, errors.Wrap(err, "could not get apiVersions from Kubernetes")
+		}
+	}
+
+	cfg.Capabilities = &chartutil.Capabilities{
+		APIVersions: apiVersions,
+		KubeVersion: chartutil.KubeVersion{
+			Version: kubeVersion.GitVersion,
+			Major:   kubeVersion.Major,
+			Minor:   kubeVersion.Minor,
+		},
+		HelmVersion: chartutil.DefaultCapabilities.HelmVersion,
+	}
+	return cfg.Capabilities, nil
+}
+
+// checkIfInstallable validates if a chart can be installed
+//
+// Application chart type is only installable
+func checkIfInstallable(ch *chart.Chart) error {
+	switch ch.Metadata.Type {
+	case "", "application":
+		return nil
+	}
+	return errors.Errorf("%s charts are not installable", ch.Metadata.Type)
+}
+
+func createRelease(i *action.Install, cfg *action.Configuration, chrt *chart.Chart, rawVals map[string]interface{}) *release.Release {
+	ts := cfg.Now()
+	return &release.Release{
+		Name:      i.ReleaseName,
+		Namespace: i.Namespace,
+		Chart:     chrt,
+		Config:    rawVals,
+		Info: &release.Info{
+			FirstDeployed: ts,
+			LastDeployed:  ts,
+			Status:        release.StatusUnknown,
+		},
+		Version: 1,
+	}
+}
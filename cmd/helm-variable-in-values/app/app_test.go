@@ -0,0 +1,98 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lazychanger/helm-variable-in-values/cmd/helm-variable-in-values/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithReleaseName(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"install", "./chart", "-g"}, []string{"install", "rel", "./chart"}},
+		{[]string{"install", "./chart", "--generate-name", "--wait"}, []string{"install", "rel", "./chart", "--wait"}},
+		{[]string{"install", "--generate-name", "./chart"}, []string{"install", "rel", "./chart"}},
+		{[]string{"install", "./chart", "--name-template", "{{ randAlpha 5 }}", "-n", "ns"}, []string{"install", "rel", "./chart", "-n", "ns"}},
+		{[]string{"install", "./chart", "--name-template={{ randAlpha 5 }}", "--generate-name=true"}, []string{"install", "rel", "./chart"}},
+		// the name is given, the flag has nothing left to do
+		{[]string{"install", "./chart", "--name-template={{ randAlpha 5 }}", "--generate-name=false"}, []string{"install", "rel", "./chart"}},
+		{[]string{"install", "./chart", "-g", "-f", "values.yaml"}, []string{"install", "rel", "./chart", "-f", "values.yaml"}},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, withReleaseName(tt.args, "rel"), tt.args)
+	}
+}
+
+func TestChangedKeys(t *testing.T) {
+	a := map[string]interface{}{
+		"name":  "rel-web",
+		"same":  1,
+		"table": map[string]interface{}{"fqdn": "web.ns.svc", "port": 80},
+		"only":  true,
+	}
+	b := map[string]interface{}{
+		"name":  "other-web",
+		"same":  1,
+		"table": map[string]interface{}{"fqdn": "web.other.svc", "port": 80},
+		"added": true,
+	}
+	assert.Equal(t, []string{"added", "name", "only", "table.fqdn"}, changedKeys("", a, b))
+	assert.Empty(t, changedKeys("", a, a))
+}
+
+func TestChartArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"install", "rel", "./chart", "--wait", "-n", "ns"}, []string{"rel", "./chart"}},
+		{[]string{"template", "--skip-tests", "./chart"}, []string{"./chart"}},
+		{[]string{"diff", "upgrade", "--allow-unreleased", "rel", "./chart"}, []string{"rel", "./chart"}},
+		{[]string{"diff", "upgrade", "--three-way-merge", "--suppress-secrets", "--detailed-exitcode", "rel", "./chart", "-f", "values.yaml"}, []string{"rel", "./chart"}},
+		{[]string{"diff", "upgrade", "--no-color", "--normalize-manifests", "--include-tests", "rel", "./chart"}, []string{"rel", "./chart"}},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, chartArgs(tt.args), tt.args)
+	}
+}
+
+func TestLookupRESTConfig(t *testing.T) {
+	kubeconfig := filepath.Join(t.TempDir(), "config")
+	assert.Nil(t, os.WriteFile(kubeconfig, []byte(`apiVersion: v1
+kind: Config
+clusters: [{name: c, cluster: {server: "https://127.0.0.1:1"}}]
+contexts: [{name: c, context: {cluster: c}}]
+current-context: c
+`), 0600))
+	settings.KubeConfig = kubeconfig
+	defer func(flags *utils.Flags) { cliFlags = flags }(cliFlags)
+
+	tests := []struct {
+		args    []string
+		cluster bool
+	}{
+		{[]string{"install", "rel", "./chart"}, true},
+		{[]string{"upgrade", "rel", "./chart"}, true},
+		{[]string{"template", "rel", "./chart"}, false},
+		{[]string{"lint", "./chart"}, false},
+		{[]string{"template", "rel", "./chart", "--viv-lookup"}, true},
+		{[]string{"install", "rel", "./chart", "--viv-lookup-fixtures", "fixtures.yaml"}, false},
+		{[]string{"template", "rel", "./chart", "--viv-lookup", "--viv-lookup-fixtures=fixtures.yaml"}, false},
+	}
+	for _, tt := range tests {
+		cliFlags = utils.ParseFlags(tt.args, boolFlags()...)
+		config, err := lookupRESTConfig(tt.args[0])
+		assert.Nil(t, err, tt.args)
+		if tt.cluster {
+			assert.NotNil(t, config, tt.args)
+			assert.Equal(t, "https://127.0.0.1:1", config.Host, tt.args)
+		} else {
+			assert.Nil(t, config, tt.args)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	vivEngine "github.com/lazychanger/helm-variable-in-values/pkg/engine"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chartutil"
+)
+
+// capabilitiesTTL is how long the capabilities of a cluster are cached
+const capabilitiesTTL = 10 * time.Minute
+
+// capabilitiesCacheCommands do not install, install and upgrade render the vivs with the capabilities
+// helm installs with, e.g. right after a CRD or a cluster upgrade
+var capabilitiesCacheCommands = map[string]bool{
+	"template": true,
+	"lint":     true,
+	"render":   true,
+	"diff":     true,
+}
+
+// cachedCapabilities returns the capabilities of the cluster for rendering the vivs of command, cached in the
+// viv cache dir per kube context and API server for the commands that do not install, so that vivs read from
+// the cache do not wait for the discovery of the cluster. Helm actions still discover the capabilities they use.
+func cachedCapabilities(cfg *action.Configuration, command string) (*chartutil.Capabilities, error) {
+	dir := cacheDir()
+	if dir == "" || cfg.Capabilities != nil || !capabilitiesCacheCommands[command] {
+		return GetCapabilities(cfg)
+	}
+	restConfig, err := cfg.RESTClientGetter.ToRESTConfig()
+	if err != nil {
+		return GetCapabilities(cfg)
+	}
+
+	sum := sha256.Sum256([]byte(settings.KubeContext + "\n" + restConfig.Host))
+	file := filepath.Join(dir, "capabilities", hex.EncodeToString(sum[:])+".json")
+	if info, err := os.Stat(file); err == nil && time.Since(info.ModTime()) < capabilitiesTTL {
+		caps := &chartutil.Capabilities{}
+		if data, err := os.ReadFile(file); err == nil && json.Unmarshal(data, caps) == nil {
+			vivLog.Debug("capabilities cache hit", "server", restConfig.Host)
+			return caps, nil
+		}
+	}
+
+	caps, err := GetCapabilities(cfg)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(caps)
+	if err == nil {
+		err = vivEngine.WriteCacheFile(file, data)
+	}
+	if err != nil {
+		vivLog.Warn("capabilities cache write failed", "err", err)
+	}
+	return caps, nil
+}
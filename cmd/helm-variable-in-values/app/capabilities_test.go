@@ -0,0 +1,44 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"helm.sh/helm/v3/pkg/action"
+)
+
+func TestCachedCapabilities(t *testing.T) {
+	t.Setenv("HELM_CACHE_HOME", t.TempDir())
+	kubeconfig := filepath.Join(t.TempDir(), "config")
+	assert.Nil(t, os.WriteFile(kubeconfig, []byte(`apiVersion: v1
+kind: Config
+clusters: [{name: c, cluster: {server: "https://127.0.0.1:1"}}]
+contexts: [{name: c, context: {cluster: c}}]
+current-context: c
+`), 0600))
+	settings.KubeConfig = kubeconfig
+
+	cfg := &action.Configuration{RESTClientGetter: settings.RESTClientGetter()}
+
+	// the cluster is unreachable
+	_, err := cachedCapabilities(cfg, "template")
+	assert.NotNil(t, err)
+
+	sum := sha256.Sum256([]byte("\nhttps://127.0.0.1:1"))
+	file := filepath.Join(cacheDir(), "capabilities", hex.EncodeToString(sum[:])+".json")
+	assert.Nil(t, os.MkdirAll(filepath.Dir(file), 0700))
+	assert.Nil(t, os.WriteFile(file, []byte(`{"KubeVersion": {"Version": "v1.99.0", "Major": "1", "Minor": "99"}}`), 0600))
+
+	caps, err := cachedCapabilities(cfg, "template")
+	assert.Nil(t, err)
+	assert.Equal(t, "v1.99.0", caps.KubeVersion.Version)
+	assert.Nil(t, cfg.Capabilities)
+
+	// install and upgrade discover the capabilities
+	_, err = cachedCapabilities(cfg, "upgrade")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,207 @@
+package app
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lazychanger/helm-variable-in-values/cmd/helm-variable-in-values/utils"
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/release"
+	"helm.sh/helm/v3/pkg/storage/driver"
+)
+
+// inProcessFlags are the flags supported in-process, with the viv flags.
+// Commands with other flags, e.g. --output, are run by the helm binary.
+var inProcessFlags = []string{
+	// values
+	"f", "values", "set", "set-string", "set-file", "set-json",
+	// chart
+	"version", "verify", "keyring", "repo-url", "username", "password", "cert-file", "key-file",
+	"insecure-skip-tls-verify", "ca-file", "pass-credentials", "devel", "dependency-update",
+	// global
+	"n", "namespace", "kubeconfig", "kube-context", "kube-token", "kube-as-user", "kube-as-groups",
+	"kube-apiserver", "kube-ca-file", "kube-tls-server-name", "kube-insecure-skip-tls-verify",
+	"registry-config", "repository-cache", "repository-config", "burst-limit", "debug",
+	// install, upgrade and lint
+	"g", "generate-name", "name-template", "dry-run", "wait", "wait-for-jobs", "timeout", "atomic",
+	"create-namespace", "description", "no-hooks", "skip-crds", "disable-openapi-validation",
+	"i", "install", "reuse-values", "reset-values", "force", "cleanup-on-fail", "history-max",
+	"strict", "with-subcharts", "post-renderer", "post-renderer-args",
+}
+
+// inProcess reports whether the command runs with the helm actions viv is built with,
+// with --viv-in-process or HELM_VIV_IN_PROCESS, instead of the helm binary
+func inProcess(command string) bool {
+	enabled, _ := strconv.ParseBool(os.Getenv("HELM_VIV_IN_PROCESS"))
+	if !enabled && !cliFlags.GetBool("viv-in-process") {
+		return false
+	}
+
+	switch command {
+	case "install", "upgrade", "lint":
+	default:
+		vivLog.Info("viv in-process does not support the command, running helm", "command", command, "helm", helmbin)
+		return false
+	}
+
+	unsupported := make([]string, 0)
+	for _, name := range cliFlags.Names() {
+		if !strings.HasPrefix(name, vivFlagPrefix) && !contains(inProcessFlags, name) {
+			unsupported = append(unsupported, "--"+name)
+		}
+	}
+	if len(unsupported) > 0 {
+		vivLog.Info("viv in-process does not support the flags, running helm", "flags", strings.Join(unsupported, ", "), "helm", helmbin)
+		return false
+	}
+	return true
+}
+
+// runInProcess runs the helm command with the viv outputs, like helm with -f for each of them
+func runInProcess(out io.Writer, command string, b *vivBuild, vivFiles []string) error {
+	valueOpts := valueOptions()
+	valueOpts.ValueFiles = append(valueOpts.ValueFiles, vivFiles...)
+	vals, err := valueOpts.MergeValues(getter.All(settings))
+	if err != nil {
+		return err
+	}
+
+	if command == "lint" {
+		return lintInProcess(out, b.chartPath, vals)
+	}
+
+	// the chart of the engine has been processed for rendering vivs, the actions process it again
+	ch, err := loader.Load(b.chartPath)
+	if err != nil {
+		return err
+	}
+
+	timeout, err := helmTimeout()
+	if err != nil {
+		return err
+	}
+
+	pr, err := postRenderer(b)
+	if err != nil {
+		return renderFailed(err)
+	}
+	ctx, cancel := lc.context()
+	defer cancel()
+
+	var rel *release.Release
+	if command == "upgrade" && !upgradeInstalls(b.releaseName) {
+		client := action.NewUpgrade(actionConfig)
+		client.Namespace = settings.Namespace()
+		client.DryRun = cliFlags.GetBool("dry-run")
+		client.Wait = cliFlags.GetBool("wait")
+		client.WaitForJobs = cliFlags.GetBool("wait-for-jobs")
+		client.Timeout = timeout
+		client.Atomic = cliFlags.GetBool("atomic")
+		client.DisableHooks = cliFlags.GetBool("no-hooks")
+		client.SkipCRDs = cliFlags.GetBool("skip-crds")
+		client.DisableOpenAPIValidation = cliFlags.GetBool("disable-openapi-validation")
+		client.Description = cliFlags.GetString("description")
+		client.ReuseValues = cliFlags.GetBool("reuse-values")
+		client.ResetValues = cliFlags.GetBool("reset-values")
+		client.Force = cliFlags.GetBool("force")
+		client.CleanupOnFail = cliFlags.GetBool("cleanup-on-fail")
+		client.MaxHistory = utils.IntDefaultValue(cliFlags.GetInt("history-max"), settings.MaxHistory)
+		client.PostRenderer = pr
+
+		rel, err = client.RunWithContext(ctx, b.releaseName, ch, vals)
+	} else {
+		client := action.NewInstall(actionConfig)
+		client.ReleaseName = b.releaseName
+		client.Namespace = settings.Namespace()
+		client.CreateNamespace = cliFlags.GetBool("create-namespace")
+		client.DryRun = cliFlags.GetBool("dry-run")
+		client.Wait = cliFlags.GetBool("wait")
+		client.WaitForJobs = cliFlags.GetBool("wait-for-jobs")
+		client.Timeout = timeout
+		client.Atomic = cliFlags.GetBool("atomic")
+		client.DisableHooks = cliFlags.GetBool("no-hooks")
+		client.SkipCRDs = cliFlags.GetBool("skip-crds")
+		client.DisableOpenAPIValidation = cliFlags.GetBool("disable-openapi-validation")
+		client.Description = cliFlags.GetString("description")
+		client.PostRenderer = pr
+
+		rel, err = client.RunWithContext(ctx, ch, vals)
+	}
+	if err != nil {
+		return err
+	}
+
+	printRelease(out, rel, cliFlags.GetBool("dry-run"))
+	return nil
+}
+
+// upgradeInstalls reports whether `upgrade --install` installs the release, like helm
+func upgradeInstalls(name string) bool {
+	if !cliFlags.GetBool("install") && !cliFlags.GetBool("i") {
+		return false
+	}
+	history := action.NewHistory(actionConfig)
+	history.Max = 1
+	_, err := history.Run(name)
+	return err == driver.ErrReleaseNotFound
+}
+
+func lintInProcess(out io.Writer, chartPath string, vals map[string]interface{}) error {
+	client := action.NewLint()
+	client.Strict = cliFlags.GetBool("strict")
+	client.WithSubcharts = cliFlags.GetBool("with-subcharts")
+	client.Namespace = settings.Namespace()
+
+	result := client.Run([]string{chartPath}, vals)
+	fmt.Fprintf(out, "==> Linting %s\n", chartPath)
+	for _, msg := range result.Messages {
+		fmt.Fprintln(out, msg)
+	}
+	if len(result.Errors) > 0 {
+		return errors.Errorf("%s: chart failed linting, %d error(s)", chartPath, len(result.Errors))
+	}
+	fmt.Fprintf(out, "\n%d chart(s) linted, 0 chart(s) failed\n", result.TotalChartsLinted)
+	return nil
+}
+
+// helmTimeout is --timeout, 5m by default like helm
+func helmTimeout() (time.Duration, error) {
+	timeout := cliFlags.GetString("timeout")
+	if timeout == "" {
+		return 5 * time.Minute, nil
+	}
+	d, err := time.ParseDuration(timeout)
+	return d, errors.Wrap(err, "--timeout")
+}
+
+func printRelease(out io.Writer, rel *release.Release, manifest bool) {
+	fmt.Fprintf(out, "NAME: %s\n", rel.Name)
+	if !rel.Info.LastDeployed.IsZero() {
+		fmt.Fprintf(out, "LAST DEPLOYED: %s\n", rel.Info.LastDeployed.Format(time.ANSIC))
+	}
+	fmt.Fprintf(out, "NAMESPACE: %s\n", rel.Namespace)
+	fmt.Fprintf(out, "STATUS: %s\n", rel.Info.Status.String())
+	fmt.Fprintf(out, "REVISION: %d\n", rel.Version)
+	if manifest {
+		fmt.Fprintf(out, "MANIFEST:\n%s\n", strings.TrimSpace(rel.Manifest))
+	}
+	if notes := strings.TrimSpace(rel.Info.Notes); notes != "" {
+		fmt.Fprintf(out, "NOTES:\n%s\n", notes)
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,158 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// Exit codes of helm viv. Failures of the helm binary exit with its exit code.
+const (
+	// exitError is the exit code of the other errors, e.g. bad flags or a failing in-process helm action, like helm
+	exitError = 1
+	// exitRender is the exit code of the failures to render the vivs or the manifest patches
+	exitRender = 3
+)
+
+// forwardedSignals are forwarded to the helm process, they stop viv when no helm process runs
+var forwardedSignals = []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGHUP}
+
+// codeError is an error with the exit code of helm viv
+type codeError struct {
+	code int
+	err  error
+}
+
+func (e *codeError) Error() string { return e.err.Error() }
+func (e *codeError) Unwrap() error { return e.err }
+
+// renderFailed marks a failure to render the vivs
+func renderFailed(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &codeError{code: exitRender, err: err}
+}
+
+// exitCode returns the exit code of an error: the one of helm when it failed, 128 + the signal when it was killed
+func exitCode(err error) int {
+	var ce *codeError
+	if errors.As(err, &ce) {
+		return ce.code
+	}
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		if status, ok := ee.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+		return ee.ExitCode()
+	}
+	return exitError
+}
+
+// isHelmExit reports whether the error is the exit of the helm binary, which has already printed its error
+func isHelmExit(err error) bool {
+	var ee *exec.ExitError
+	return errors.As(err, &ee)
+}
+
+// lifecycle runs the cleanups of helm viv on every exit path, and forwards the signals to the helm process
+type lifecycle struct {
+	mu       sync.Mutex
+	cleanups []func()
+	// child is the running helm process
+	child *os.Process
+	// cancel cancels the running in-process helm action
+	cancel context.CancelFunc
+}
+
+var lc = &lifecycle{}
+
+// onExit registers fn to run before helm viv exits, e.g. to remove the generated files
+func (l *lifecycle) onExit(fn func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cleanups = append(l.cleanups, fn)
+}
+
+// cleanup runs the registered functions once, the latest first
+func (l *lifecycle) cleanup() {
+	l.mu.Lock()
+	cleanups := l.cleanups
+	l.cleanups = nil
+	l.mu.Unlock()
+
+	for i := len(cleanups) - 1; i >= 0; i-- {
+		cleanups[i]()
+	}
+}
+
+// exit cleans up and exits
+func (l *lifecycle) exit(code int) {
+	l.cleanup()
+	os.Exit(code)
+}
+
+// handleSignals forwards the signals to the helm process. A signal cancels the running in-process action,
+// and stops viv when there is nothing to cancel, with the exit code of a process killed by the signal.
+func (l *lifecycle) handleSignals() {
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, forwardedSignals...)
+	go func() {
+		for sig := range c {
+			l.mu.Lock()
+			child, cancel := l.child, l.cancel
+			l.cancel = nil
+			l.mu.Unlock()
+
+			switch {
+			case child != nil:
+				vivLog.Debug("forward signal to helm", "signal", sig, "pid", child.Pid)
+				_ = child.Signal(sig)
+			case cancel != nil:
+				vivLog.Warn(fmt.Sprintf("%s, cancelling", sig))
+				cancel()
+			default:
+				code := exitError
+				if s, ok := sig.(syscall.Signal); ok {
+					code = 128 + int(s)
+				}
+				l.exit(code)
+			}
+		}
+	}()
+}
+
+// run runs the helm process, with the signals forwarded to it. The process is started under the lock,
+// so that a signal received while it starts waits for it, instead of stopping viv and orphaning helm.
+func (l *lifecycle) run(cmd *exec.Cmd) error {
+	l.mu.Lock()
+	if err := cmd.Start(); err != nil {
+		l.mu.Unlock()
+		return err
+	}
+	l.child = cmd.Process
+	l.mu.Unlock()
+
+	err := cmd.Wait()
+
+	l.mu.Lock()
+	l.child = nil
+	l.mu.Unlock()
+	return err
+}
+
+// context returns the context of an in-process helm action, cancelled by the first signal
+func (l *lifecycle) context() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	l.mu.Lock()
+	l.cancel = cancel
+	l.mu.Unlock()
+	return ctx, cancel
+}
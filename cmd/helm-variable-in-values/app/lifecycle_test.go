@@ -0,0 +1,34 @@
+package app
+
+import (
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLifecycleRun(t *testing.T) {
+	l := &lifecycle{}
+	assert.Equal(t, 3, exitCode(l.run(exec.Command("sh", "-c", "exit 3"))))
+
+	done := make(chan error)
+	go func() { done <- l.run(exec.Command("sleep", "10")) }()
+
+	// the child is recorded as soon as it is started, a signal reaches it
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		l.mu.Lock()
+		child := l.child
+		l.mu.Unlock()
+		if child != nil {
+			assert.Nil(t, child.Signal(syscall.SIGTERM))
+			break
+		}
+	}
+	assert.Equal(t, 128+int(syscall.SIGTERM), exitCode(<-done))
+	assert.Nil(t, l.child)
+
+	assert.NotNil(t, l.run(exec.Command("/nonexistent")))
+	assert.Nil(t, l.child)
+}
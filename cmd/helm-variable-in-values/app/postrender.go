@@ -0,0 +1,90 @@
+package app
+
+import (
+	"bytes"
+	"io"
+	"os"
+
+	"github.com/lazychanger/helm-variable-in-values/cmd/helm-variable-in-values/utils"
+	vivEngine "github.com/lazychanger/helm-variable-in-values/pkg/engine"
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/postrender"
+)
+
+// postRenderCommand is run by helm as its post-renderer: helm viv post-render <patches> [<post-renderer> [args...]]
+const postRenderCommand = "post-render"
+
+// withPostRenderer makes helm run viv as its post-renderer to apply the manifest patches.
+// The post-renderer of the user runs on the patched manifests.
+func withPostRenderer(args []string, patches string) ([]string, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, errors.Wrap(err, "viv post-renderer")
+	}
+
+	postRenderArgs := []string{postRenderCommand, patches}
+	if bin := cliFlags.GetString("post-renderer"); bin != "" {
+		postRenderArgs = append(append(postRenderArgs, bin), cliFlags.GetStringSlice("post-renderer-args")...)
+	}
+
+	out := append(utils.RemoveFlags(args, "post-renderer"), "--post-renderer", self)
+	for _, arg := range postRenderArgs {
+		out = append(out, "--post-renderer-args", arg)
+	}
+	return out, nil
+}
+
+// postRender patches the manifests helm writes to stdin, then runs the post-renderer of the user
+func postRender(in io.Reader, out io.Writer, args []string) error {
+	if len(args) < 1 {
+		return errors.Errorf("usage: helm viv %s <patches> [<post-renderer> [args...]]", postRenderCommand)
+	}
+
+	patches, err := os.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	p, err := vivEngine.NewPostRenderer(patches)
+	if err != nil {
+		return err
+	}
+	if len(args) > 1 {
+		if p.Next, err = postrender.NewExec(args[1], args[2:]...); err != nil {
+			return err
+		}
+	}
+
+	manifests := &bytes.Buffer{}
+	if _, err := io.Copy(manifests, in); err != nil {
+		return err
+	}
+	patched, err := p.Run(manifests)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, patched)
+	return err
+}
+
+// postRenderer returns the post-renderer of the in-process actions, the manifest patches then
+// the post-renderer of the user, or nil without both
+func postRenderer(b *vivBuild) (postrender.PostRenderer, error) {
+	var user postrender.PostRenderer
+	if bin := cliFlags.GetString("post-renderer"); bin != "" {
+		var err error
+		if user, err = postrender.NewExec(bin, cliFlags.GetStringSlice("post-renderer-args")...); err != nil {
+			return nil, err
+		}
+	}
+
+	patches, err := b.RenderPatches()
+	if err != nil || patches == nil {
+		return user, err
+	}
+	p, err := vivEngine.NewPostRenderer(patches)
+	if err != nil {
+		return nil, err
+	}
+	p.Next = user
+	return p, nil
+}
@@ -1,6 +1,8 @@
 package utils
 
 import (
+	"github.com/lazychanger/helm-variable-in-values/pkg/logger"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -38,6 +40,24 @@ func (f *Flags) GetInt(keys ...string) int {
 	return intVal
 }
 
+// Has reports whether the flag is set, with or without a value
+func (f *Flags) Has(key string) bool {
+	f.init()
+	_, ok := f.flags[key]
+	return ok
+}
+
+// Names returns the names of the flags that are set, sorted
+func (f *Flags) Names() []string {
+	f.init()
+	names := make([]string, 0, len(f.flags))
+	for name := range f.flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func (f *Flags) GetBool(key string) bool {
 	f.init()
 
@@ -65,7 +85,8 @@ func (f *Flags) init() {
 	}
 }
 
-func ParseFlags(args []string) *Flags {
+// ParseFlags parses the flags of args. Flags listed in boolFlags never take a separate value.
+func ParseFlags(args []string, boolFlags ...string) *Flags {
 	flags := &Flags{}
 
 	next := false
@@ -91,6 +112,8 @@ func ParseFlags(args []string) *Flags {
 			idx := strings.Index(arg, "=")
 			if idx > -1 {
 				flags.set(strings.Trim(arg[0:idx], "-"), arg[idx+1:])
+			} else if isBoolFlag(strings.Trim(arg, "-"), boolFlags) {
+				flags.set(strings.Trim(arg, "-"))
 			} else {
 				key = strings.Trim(arg, "-")
 				next = true
@@ -98,6 +121,10 @@ func ParseFlags(args []string) *Flags {
 			continue
 		}
 
+		if isBoolFlag(strings.Trim(arg, "-"), boolFlags) {
+			flags.set(strings.Trim(arg, "-"))
+			continue
+		}
 		key = strings.Trim(arg, "-")
 		next = true
 	}
@@ -138,3 +165,120 @@ func StringSliceDefaultValue(val, defaultValue []string) []string {
 	}
 	return val
 }
+
+// RemoveFlags returns args without the flags starting with prefix, and their values.
+// Flags listed in boolFlags never take a separate value.
+func RemoveFlags(args []string, prefix string, boolFlags ...string) []string {
+	out := make([]string, 0, len(args))
+	skipValue := false
+	for _, arg := range args {
+		if skipValue {
+			skipValue = false
+			if !strings.HasPrefix(arg, "-") {
+				continue
+			}
+		}
+
+		if !strings.HasPrefix(arg, "--"+prefix) {
+			out = append(out, arg)
+			continue
+		}
+
+		name := strings.TrimPrefix(arg, "--")
+		if strings.Contains(name, "=") {
+			continue
+		}
+		skipValue = !isBoolFlag(name, boolFlags)
+	}
+	return out
+}
+
+// Positionals returns the arguments that are neither flags nor flag values.
+// Flags listed in boolFlags never take a separate value.
+func Positionals(args []string, boolFlags ...string) []string {
+	out := make([]string, 0, len(args))
+	skipValue := false
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			if !skipValue {
+				out = append(out, arg)
+			}
+			skipValue = false
+			continue
+		}
+		skipValue = !strings.Contains(arg, "=") && !isBoolFlag(strings.TrimLeft(arg, "-"), boolFlags)
+	}
+	return out
+}
+
+// RedactArgs returns the args for logging, with the values of credential flags,
+// e.g. --password, and of --set keys like secrets replaced. Flags listed in boolFlags never take a separate value,
+// the argument after another flag is its value, even when it starts with "-", e.g. a password.
+func RedactArgs(args []string, boolFlags ...string) []string {
+	out := make([]string, 0, len(args))
+	flag := ""
+	for _, arg := range args {
+		if flag != "" {
+			out = append(out, redactValue(flag, arg))
+			flag = ""
+			continue
+		}
+		if !strings.HasPrefix(arg, "-") {
+			out = append(out, arg)
+			continue
+		}
+
+		name, val, ok := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !ok {
+			if !isBoolFlag(name, boolFlags) {
+				flag = name
+			}
+			out = append(out, arg)
+			continue
+		}
+		out = append(out, strings.TrimSuffix(arg, val)+redactValue(name, val))
+	}
+	return out
+}
+
+func redactValue(flag, val string) string {
+	switch {
+	case logger.IsSensitive(flag):
+		return logger.Redacted
+	case flag == "set" || flag == "set-string":
+		pairs := strings.Split(val, ",")
+		for i, pair := range pairs {
+			if key, _, ok := strings.Cut(pair, "="); ok && logger.IsSensitive(key) {
+				pairs[i] = key + "=" + logger.Redacted
+			}
+		}
+		return strings.Join(pairs, ",")
+	case flag == "set-json":
+		if key, _, ok := strings.Cut(val, "="); ok && logger.IsSensitive(key) {
+			return key + "=" + logger.Redacted
+		}
+	}
+	return val
+}
+
+func isBoolFlag(name string, boolFlags []string) bool {
+	for _, f := range boolFlags {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// SplitList splits comma separated values, dropping empty items
+func SplitList(vals ...string) []string {
+	out := make([]string, 0)
+	for _, val := range vals {
+		for _, item := range strings.Split(val, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				out = append(out, item)
+			}
+		}
+	}
+	return out
+}
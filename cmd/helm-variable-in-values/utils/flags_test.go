@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFlags(t *testing.T) {
+	tests := []struct {
+		args []string
+		want map[string][]string
+	}{
+		{[]string{"install", "rel", "./chart", "-f", "a.yaml", "--values", "b.yaml"}, map[string][]string{"f": {"a.yaml"}, "values": {"b.yaml"}}},
+		{[]string{"install", "--dry-run", "rel", "./chart"}, map[string][]string{"dry-run": {}}},
+		{[]string{"install", "--wait=false", "--timeout=5m", "rel"}, map[string][]string{"wait": {"false"}, "timeout": {"5m"}}},
+		{[]string{"install", "-g", "./chart", "--set", "a=1", "--set", "b=2"}, map[string][]string{"g": {}, "set": {"a=1", "b=2"}}},
+		{[]string{"install", "--namespace", "--debug"}, map[string][]string{"namespace": {}, "debug": {}}},
+		{[]string{"lint", "./chart", "--strict"}, map[string][]string{"strict": {}}},
+	}
+	for _, tt := range tests {
+		flags := ParseFlags(tt.args, "dry-run", "wait", "g", "debug", "strict")
+		assert.Equal(t, tt.want, flags.flags, tt.args)
+	}
+
+	flags := ParseFlags([]string{"install", "--dry-run", "--wait=false", "--history-max", "3"}, "dry-run", "wait")
+	assert.True(t, flags.GetBool("dry-run"))
+	assert.False(t, flags.GetBool("wait"))
+	assert.True(t, flags.Has("wait"))
+	assert.Equal(t, 3, flags.GetInt("history-max"))
+	assert.Equal(t, []string{"dry-run", "history-max", "wait"}, flags.Names())
+}
+
+func TestPositionals(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"install", "rel", "./chart"}, []string{"install", "rel", "./chart"}},
+		{[]string{"install", "--dry-run", "rel", "./chart"}, []string{"install", "rel", "./chart"}},
+		{[]string{"install", "-f", "a.yaml", "rel", "./chart"}, []string{"install", "rel", "./chart"}},
+		{[]string{"install", "--set=a=1", "rel", "-n", "ns", "./chart"}, []string{"install", "rel", "./chart"}},
+		{[]string{"install", "-g", "./chart", "--wait"}, []string{"install", "./chart"}},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, Positionals(tt.args, "dry-run", "g", "wait"), tt.args)
+	}
+}
+
+func TestRedactArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"install", "--password", "hunter2", "rel"}, []string{"install", "--password", "***", "rel"}},
+		{[]string{"install", "--password", "-hunter2", "rel"}, []string{"install", "--password", "***", "rel"}},
+		{[]string{"install", "--password=hunter2"}, []string{"install", "--password=***"}},
+		{[]string{"install", "--set", "a.password=x,image.tag=1"}, []string{"install", "--set", "a.password=***,image.tag=1"}},
+		{[]string{"install", "--set-string=db.password=x"}, []string{"install", "--set-string=db.password=***"}},
+		{[]string{"install", "--set-json", `auth.token={"v":"x"}`}, []string{"install", "--set-json", "auth.token=***"}},
+		{[]string{"install", "--set-json", `image={"tag":"1"}`}, []string{"install", "--set-json", `image={"tag":"1"}`}},
+		{[]string{"install", "--dry-run", "rel", "--username", "admin"}, []string{"install", "--dry-run", "rel", "--username", "admin"}},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, RedactArgs(tt.args, "dry-run"), tt.args)
+	}
+}
@@ -0,0 +1,21 @@
+// A helm-viv binary with custom functions for vivs.
+//
+//	go build -o bin/helm-viv ./example/custom-funcs
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/lazychanger/helm-variable-in-values/cmd/helm-variable-in-values/app"
+)
+
+func main() {
+	app.Execute(template.FuncMap{
+		// {{ teamName "payments" "api" }} => team-payments-api
+		"teamName": func(team, name string) string {
+			return strings.ToLower(fmt.Sprintf("team-%s-%s", team, name))
+		},
+	})
+}
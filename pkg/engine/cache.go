@@ -0,0 +1,131 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"helm.sh/helm/v3/pkg/chart"
+)
+
+// cacheVersion is part of every cache key, bump it when the output of the engine changes
+const cacheVersion = "2"
+
+type cacheEntry struct {
+	Files   []*chart.File `json:"files"`
+	EnvRead []string      `json:"envRead"`
+}
+
+// cachedRender renders the vivs, or reads their outputs from Config.CacheDir when
+// nothing they depend on has changed
+func (e *Engine) cachedRender() ([]*chart.File, error) {
+	key, ok := e.cacheKey()
+	if !ok {
+		return e.render()
+	}
+
+	file := filepath.Join(e.cfg.CacheDir, key+".json")
+	if data, err := os.ReadFile(file); err == nil {
+		entry := cacheEntry{}
+		if err := json.Unmarshal(data, &entry); err == nil {
+			e.log.Debug("viv cache hit", "key", key)
+			e.env.record(entry.EnvRead...)
+			return entry.Files, nil
+		}
+	}
+
+	files, err := e.render()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(cacheEntry{Files: files, EnvRead: e.env.Read()})
+	if err == nil {
+		err = WriteCacheFile(file, data)
+	}
+	if err != nil {
+		e.log.Warn("viv cache write failed", "err", err)
+	}
+	return files, nil
+}
+
+// WriteCacheFile writes a file of the viv cache, which may hold secrets, readable by the user only. The file is
+// renamed into place, so that concurrent runs never read a partial entry.
+func WriteCacheFile(file string, data []byte) error {
+	dir := filepath.Dir(file)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// cacheKey hashes everything the viv outputs depend on: the chart files, the values,
+// the release options, the capabilities and the engine options.
+// Outputs that depend on lookup are not cached.
+func (e *Engine) cacheKey() (string, bool) {
+	if e.cfg.CacheDir == "" || e.cfg.RESTConfig != nil || e.cfg.Lookup != nil {
+		return "", false
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "version:%s\nbuild:%s\n", cacheVersion, e.cfg.BuildVersion)
+	hashChart(h, e.cfg.Chart)
+
+	for _, k := range []string{"Values", "Release", "Capabilities"} {
+		data, err := json.Marshal(e.cfg.Values[k])
+		if err != nil {
+			return "", false
+		}
+		fmt.Fprintf(h, "%s:%s\n", k, data)
+	}
+
+	settings, _ := json.Marshal(e.cfg.Settings)
+	fmt.Fprintf(h, "settings:%s\nenv:%s\n", settings, e.cfg.Env)
+
+	funcs := make([]string, 0, len(e.cfg.Funcs))
+	for name := range e.cfg.Funcs {
+		funcs = append(funcs, name)
+	}
+	sort.Strings(funcs)
+
+	fmt.Fprintf(h, "env:%q\nfuncs:%q\ndeterministic:%t,%t,%d\n",
+		e.env.Allowed(), funcs, e.cfg.Deterministic, e.cfg.ForbidNondeterministic, e.cfg.Now.Unix())
+
+	return hex.EncodeToString(h.Sum(nil)), true
+}
+
+// hashChart hashes the metadata and the files of a chart and its dependencies
+func hashChart(h hash.Hash, ch *chart.Chart) {
+	meta, _ := json.Marshal(ch.Metadata)
+	fmt.Fprintf(h, "chart:%s:%s\n", ch.ChartFullPath(), meta)
+
+	files := make([]*chart.File, len(ch.Raw))
+	copy(files, ch.Raw)
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	for _, f := range files {
+		fmt.Fprintf(h, "file:%s:%d\n", f.Name, len(f.Data))
+		h.Write(f.Data)
+	}
+
+	for _, d := range ch.Dependencies() {
+		hashChart(h, d)
+	}
+}
@@ -1,12 +1,54 @@
 package engine
 
 import (
+	"text/template"
+	"time"
+
+	"github.com/lazychanger/helm-variable-in-values/pkg/logger"
 	"helm.sh/helm/v3/pkg/chart"
 	"helm.sh/helm/v3/pkg/chartutil"
+	"k8s.io/client-go/rest"
 )
 
 type Config struct {
 	WorkDir string
 	Values  chartutil.Values
 	Chart   *chart.Chart
+	// Debug logs the decisions of the engine, e.g. the skipped viv files
+	Debug bool
+	// Logger logs the engine, logger.Default() when nil
+	Logger *logger.Logger
+
+	// EnvAllow are the patterns of the environment variables vivs can read with `env`
+	EnvAllow []string
+	// Funcs are added to the functions of every viv, replacing functions with the same name
+	Funcs template.FuncMap
+
+	// Deterministic seeds the random functions from the release and the viv file, and fixes `now` to Now
+	Deterministic bool
+	// ForbidNondeterministic makes random and time functions fail
+	ForbidNondeterministic bool
+	// Now is the time returned by `now` in deterministic mode
+	Now time.Time
+
+	// RESTConfig, when set, makes `lookup` read from the cluster
+	RESTConfig *rest.Config
+	// Lookup, when set, replaces `lookup`, e.g. with LookupFixtures.Lookup. It takes precedence over RESTConfig.
+	Lookup func(apiVersion, kind, namespace, name string) (map[string]interface{}, error)
+
+	// CacheDir, when set, caches the viv outputs
+	CacheDir string
+	// BuildVersion identifies the build of viv, e.g. its version and git commit. It is part of the cache key,
+	// so that another build, whose functions may give other outputs, does not reuse the cached outputs.
+	BuildVersion string
+
+	// Env selects the environment overlay, the viv files under <vivDir>/_env/<Env>/ of every chart.
+	// Vivs read it as .Viv.Env.
+	Env string
+
+	// Settings override the viv settings of every chart
+	Settings Settings
+
+	// Concurrency is the number of charts whose vivs are rendered at the same time, 1 if not set
+	Concurrency int
 }
@@ -0,0 +1,150 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	alphaChars   = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	numericChars = "0123456789"
+)
+
+// seededFuncs are the random and time functions that deterministic mode replaces
+var seededFuncs = append([]string{"now", "ago"}, randomFuncs...)
+
+// randomFuncs are seeded per call site, they get it as first argument
+var randomFuncs = []string{
+	"randAlphaNum", "randAlpha", "randAscii", "randNumeric", "randBytes", "randInt", "uuidv4", "shuffle",
+}
+
+// unseedableFuncs can not be made deterministic, they always fail in deterministic mode
+var unseedableFuncs = []string{
+	"genPrivateKey", "genCA", "genCAWithKey", "genSelfSignedCert", "genSelfSignedCertWithKey",
+	"genSignedCert", "genSignedCertWithKey", "bcrypt", "htpasswd", "encryptAES",
+}
+
+// determinism replaces the non-deterministic functions of vivs.
+//
+// In deterministic mode, each call site of a random function in a viv file gets its own random
+// generator, seeded from the release name, the namespace, the file name and the call site: the
+// YAML key path of the call and the call itself. Rendering the same inputs again gives the same values,
+// editing other lines of the file keeps them, and `now` returns a fixed time.
+// When forbid is set, every non-deterministic function fails instead.
+type determinism struct {
+	release   string
+	namespace string
+	now       time.Time
+	forbid    bool
+
+	mu   sync.Mutex
+	rngs map[string]*rand.Rand
+}
+
+func newDeterminism(release, namespace string, now time.Time, forbid bool) *determinism {
+	return &determinism{
+		release:   release,
+		namespace: namespace,
+		now:       now.UTC(),
+		forbid:    forbid,
+		rngs:      map[string]*rand.Rand{},
+	}
+}
+
+// Funcs returns the functions for the viv file name
+func (d *determinism) Funcs(name string) template.FuncMap {
+	funcs := template.FuncMap{}
+	for _, fn := range unseedableFuncs {
+		funcs[fn] = d.fail(fn, "can not be made deterministic")
+	}
+	if d.forbid {
+		for _, fn := range seededFuncs {
+			funcs[fn] = d.fail(fn, "is not deterministic")
+		}
+		return funcs
+	}
+
+	rng := func(site string) *rand.Rand { return d.rng(name + "\x00" + site) }
+	funcs["randAlphaNum"] = func(site string, n int) string { return randString(rng(site), n, alphaChars+numericChars) }
+	funcs["randAlpha"] = func(site string, n int) string { return randString(rng(site), n, alphaChars) }
+	funcs["randNumeric"] = func(site string, n int) string { return randString(rng(site), n, numericChars) }
+	funcs["randAscii"] = func(site string, n int) string {
+		r := rng(site)
+		b := make([]byte, n)
+		for i := range b {
+			b[i] = byte(32 + r.Intn(95))
+		}
+		return string(b)
+	}
+	funcs["randBytes"] = func(site string, n int) string {
+		b := make([]byte, n)
+		_, _ = rng(site).Read(b)
+		return base64.StdEncoding.EncodeToString(b)
+	}
+	funcs["randInt"] = func(site string, lo, hi int) int { return rng(site).Intn(hi-lo) + lo }
+	funcs["uuidv4"] = func(site string) string {
+		b := make([]byte, 16)
+		_, _ = rng(site).Read(b)
+		b[6] = b[6]&0x0f | 0x40
+		b[8] = b[8]&0x3f | 0x80
+		return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+	}
+	funcs["shuffle"] = func(site string, s string) string {
+		r := []rune(s)
+		rng(site).Shuffle(len(r), func(i, j int) { r[i], r[j] = r[j], r[i] })
+		return string(r)
+	}
+	funcs["now"] = func() time.Time { return d.now }
+	funcs["ago"] = func(i interface{}) string {
+		var t time.Time
+		switch date := i.(type) {
+		case time.Time:
+			t = date
+		case int:
+			t = time.Unix(int64(date), 0)
+		case int64:
+			t = time.Unix(date, 0)
+		default:
+			return ""
+		}
+		return d.now.Sub(t).Round(time.Second).String()
+	}
+	return funcs
+}
+
+// rng returns the generator of a call site of a viv file, it keeps its state across calls
+// so that a call in a loop, or in a template included several times, gives new values
+func (d *determinism) rng(name string) *rand.Rand {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if rng, ok := d.rngs[name]; ok {
+		return rng
+	}
+	sum := sha256.Sum256([]byte(d.release + "\x00" + d.namespace + "\x00" + name))
+	rng := rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(sum[:8]))))
+	d.rngs[name] = rng
+	return rng
+}
+
+func (d *determinism) fail(fn, reason string) func(...interface{}) (string, error) {
+	return func(...interface{}) (string, error) {
+		return "", errors.Errorf("%s %s, it can not be used in deterministic mode", fn, reason)
+	}
+}
+
+func randString(rng *rand.Rand, n int, chars string) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = chars[rng.Intn(len(chars))]
+	}
+	return string(b)
+}
@@ -0,0 +1,331 @@
+package engine
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/mitchellh/copystructure"
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/chartutil"
+)
+
+// Directives are resolved against the values and the outputs of the previous vivs before the viv output is handed to helm.
+//
+//	name:
+//	  $default: "{{ .Release.Name }}-svc"   # only applied when name is empty
+//	annotations:
+//	  $delete: true                         # removes the key, it is written as null for helm
+//	args:
+//	  $append: ["--verbose"]                # appended to the current list
+//	containers:
+//	  $mergeBy: name                        # merged into the current item with the same name,
+//	  $items:                               # appended when there is none
+//	    - name: app
+//	      image: nginx
+const (
+	defaultKey = "$default"
+	deleteKey  = "$delete"
+	appendKey  = "$append"
+	prependKey = "$prepend"
+	mergeByKey = "$mergeBy"
+	itemsKey   = "$items"
+)
+
+var directiveKeys = map[string]bool{
+	defaultKey: true,
+	deleteKey:  true,
+	appendKey:  true,
+	prependKey: true,
+	mergeByKey: true,
+	itemsKey:   true,
+}
+
+// fillOnlySuffixes mark a whole viv file as fill-only, e.g. vivs/selector.default.yaml
+var fillOnlySuffixes = []string{".default.yaml", ".default.yml"}
+
+// isFillOnly reports whether every key of the viv file should only be applied when it is empty
+func isFillOnly(name string) bool {
+	base := path.Base(name)
+	for _, suffix := range fillOnlySuffixes {
+		if strings.HasSuffix(base, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveDirectives resolves the directives in viv against the resolved values, the values with the outputs
+// of the previous vivs merged like helm merges them.
+// When fillOnly is true, every key is treated as if it was marked with `$default`.
+func resolveDirectives(viv, resolved map[string]interface{}, fillOnly bool) (map[string]interface{}, error) {
+	return resolveTable("", viv, resolved, fillOnly)
+}
+
+func resolveTable(prefix string, viv, resolved map[string]interface{}, fillOnly bool) (map[string]interface{}, error) {
+	out := make(map[string]interface{}, len(viv))
+	for k, v := range viv {
+		key := strings.TrimPrefix(prefix+"."+k, ".")
+		cur, isSet := resolved[k]
+
+		directive, ok, err := asDirective(key, v)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			dv, keep, err := directive.apply(key, cur, isSet, fillOnly)
+			if err != nil {
+				return nil, err
+			}
+			if keep {
+				out[k] = dv
+			}
+			continue
+		}
+
+		if fillOnly {
+			fv, keep, err := fillValue(key, v, cur)
+			if err != nil {
+				return nil, err
+			}
+			if keep {
+				out[k] = fv
+			}
+			continue
+		}
+
+		if m, ok := asMap(v); ok {
+			curMap, _ := asMap(cur)
+			if out[k], err = resolveTable(key, m, curMap, false); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		out[k] = v
+	}
+	return out, nil
+}
+
+type directive map[string]interface{}
+
+// asDirective returns v as a directive if it is a table made of directive keys only
+func asDirective(key string, v interface{}) (directive, bool, error) {
+	m, ok := asMap(v)
+	if !ok || len(m) == 0 {
+		return nil, false, nil
+	}
+
+	found := make([]string, 0)
+	for k := range m {
+		if directiveKeys[k] {
+			found = append(found, k)
+		}
+	}
+	if len(found) == 0 {
+		return nil, false, nil
+	}
+	if len(found) != len(m) {
+		return nil, false, errors.Errorf("%s: directive %s can not be mixed with values", key, strings.Join(found, ", "))
+	}
+	return m, true, nil
+}
+
+// apply returns the value to write for the directive and whether it should be written at all.
+// cur is the resolved value of the key and isSet whether the key is in the resolved values.
+func (d directive) apply(key string, cur interface{}, isSet, fillOnly bool) (interface{}, bool, error) {
+	switch {
+	case d.has(defaultKey):
+		if err := d.only(key, defaultKey); err != nil {
+			return nil, false, err
+		}
+		return fillValue(key, d[defaultKey], cur)
+	case d.has(deleteKey):
+		if err := d.only(key, deleteKey); err != nil {
+			return nil, false, err
+		}
+		del, ok := d[deleteKey].(bool)
+		if !ok {
+			return nil, false, errors.Errorf("%s: %s must be a boolean", key, deleteKey)
+		}
+		// null removes the key when helm merges the values, nothing to do if no values nor previous viv set it
+		return nil, del && isSet, nil
+	}
+
+	if fillOnly && !isEmpty(cur) {
+		return nil, false, nil
+	}
+
+	curList, ok := cur.([]interface{})
+	if !ok && cur != nil {
+		return nil, false, errors.Errorf("%s: %s needs a list, got %T", key, d.name(), cur)
+	}
+
+	switch {
+	case d.has(appendKey), d.has(prependKey):
+		if d.has(mergeByKey) || d.has(itemsKey) {
+			return nil, false, errors.Errorf("%s: %s can not be used with %s", key, d.name(), mergeByKey)
+		}
+		out := make([]interface{}, 0, len(curList))
+		prepend, err := d.list(key, prependKey)
+		if err != nil {
+			return nil, false, err
+		}
+		appends, err := d.list(key, appendKey)
+		if err != nil {
+			return nil, false, err
+		}
+		out = append(out, prepend...)
+		out = append(out, curList...)
+		out = append(out, appends...)
+		return out, true, nil
+	case d.has(mergeByKey):
+		return d.mergeBy(key, curList)
+	}
+
+	return nil, false, errors.Errorf("%s: %s needs %s", key, itemsKey, mergeByKey)
+}
+
+// mergeBy merges each item into the item of current with the same value for the $mergeBy field,
+// items without a match are appended
+func (d directive) mergeBy(key string, current []interface{}) (interface{}, bool, error) {
+	field, ok := d[mergeByKey].(string)
+	if !ok || field == "" {
+		return nil, false, errors.Errorf("%s: %s must be a field name", key, mergeByKey)
+	}
+	items, err := d.list(key, itemsKey)
+	if err != nil {
+		return nil, false, err
+	}
+
+	cp, err := copystructure.Copy(current)
+	if err != nil {
+		return nil, false, errors.Wrap(err, key)
+	}
+	out, _ := cp.([]interface{})
+
+	for i, item := range items {
+		itemMap, ok := asMap(item)
+		if !ok || itemMap[field] == nil {
+			return nil, false, errors.Errorf("%s: %s[%d] needs field %q", key, itemsKey, i, field)
+		}
+
+		idx := -1
+		for j, c := range out {
+			if cm, ok := asMap(c); ok && fmt.Sprint(cm[field]) == fmt.Sprint(itemMap[field]) {
+				idx = j
+				break
+			}
+		}
+		if idx < 0 {
+			out = append(out, itemMap)
+			continue
+		}
+
+		curMap, _ := asMap(out[idx])
+		out[idx] = chartutil.CoalesceTables(itemMap, curMap)
+	}
+	return out, true, nil
+}
+
+func (d directive) has(k string) bool {
+	_, ok := d[k]
+	return ok
+}
+
+func (d directive) only(key, k string) error {
+	if len(d) != 1 {
+		return errors.Errorf("%s: %s can not be used with other directives", key, k)
+	}
+	return nil
+}
+
+func (d directive) name() string {
+	for _, k := range []string{appendKey, prependKey, mergeByKey, itemsKey} {
+		if d.has(k) {
+			return k
+		}
+	}
+	return ""
+}
+
+func (d directive) list(key, k string) ([]interface{}, error) {
+	v, ok := d[k]
+	if !ok || v == nil {
+		return nil, nil
+	}
+	l, ok := v.([]interface{})
+	if !ok {
+		return nil, errors.Errorf("%s: %s must be a list", key, k)
+	}
+	return l, nil
+}
+
+// fillValue returns the value that should be applied over cur and whether there is one.
+// Tables are filled key by key.
+func fillValue(key string, v, cur interface{}) (interface{}, bool, error) {
+	m, ok := asMap(v)
+	if !ok {
+		return v, isEmpty(cur), nil
+	}
+
+	curMap, ok := asMap(cur)
+	if !ok && !isEmpty(cur) {
+		return nil, false, nil
+	}
+
+	filled, err := resolveTable(key, m, curMap, !isEmpty(cur))
+	if err != nil {
+		return nil, false, err
+	}
+	return filled, isEmpty(cur) || len(filled) > 0, nil
+}
+
+// isEmpty reports whether a value is unset: nil, an empty string, an empty table or an empty list.
+// false and 0 are explicit values and are not empty.
+func isEmpty(v interface{}) bool {
+	switch val := v.(type) {
+	case nil:
+		return true
+	case string:
+		return val == ""
+	case []interface{}:
+		return len(val) == 0
+	}
+	if m, ok := asMap(v); ok {
+		return len(m) == 0
+	}
+	return false
+}
+
+func asMap(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m, true
+	case chartutil.Values:
+		return m, true
+	}
+	return nil, false
+}
+
+// mergeResolved merges the output of a viv into the resolved values, like helm merges -f files:
+// the output wins, and null removes the key
+func mergeResolved(dst, src map[string]interface{}) {
+	for k, v := range src {
+		if v == nil {
+			delete(dst, k)
+			continue
+		}
+		if next, ok := asMap(v); ok {
+			if cur, ok := asMap(dst[k]); ok {
+				mergeResolved(cur, next)
+				continue
+			}
+			cp := map[string]interface{}{}
+			mergeResolved(cp, next)
+			dst[k] = cp
+			continue
+		}
+		dst[k] = v
+	}
+}
@@ -2,25 +2,55 @@ package engine
 
 import (
 	"fmt"
+	"github.com/lazychanger/helm-variable-in-values/pkg/logger"
+	"github.com/lazychanger/helm-variable-in-values/pkg/render"
+	"github.com/lazychanger/helm-variable-in-values/pkg/utils"
+	"github.com/mitchellh/copystructure"
 	"github.com/pkg/errors"
 	"helm.sh/helm/v3/pkg/chart"
-	"helm.sh/helm/v3/pkg/engine"
+	"helm.sh/helm/v3/pkg/chartutil"
 	"log"
 	"os"
 	"path"
 	"regexp"
+	"sigs.k8s.io/yaml"
+	"sort"
 	"strings"
+	"text/template"
 )
 
 type Engine struct {
 	cfg *Config
 
-	vivFileDirs []string
+	vivFileDirs   []string
+	env           *envAccess
+	chartSettings chartSettings
+	// skipped are the viv files whose when expression is false
+	skipped map[string]bool
+	log     *logger.Logger
+	// ws is the workspace of RenderToTemp
+	ws *workspace
+}
+
+// vivFile is a viv file named after its path in the umbrella chart, e.g. parent/charts/child/vivs/values.yaml
+type vivFile struct {
+	*chart.File
+	chart *chart.Chart
 }
 
 func NewEngine(cfg *Config) *Engine {
+	l := cfg.Logger
+	if l == nil {
+		l = logger.Default()
+	}
+	if cfg.Debug {
+		l = l.WithLevel(logger.LevelDebug)
+	}
+
 	return &Engine{
 		cfg: cfg,
+		env: newEnvAccess(cfg.EnvAllow),
+		log: l,
 	}
 }
 
@@ -35,55 +65,127 @@ func (e *Engine) RenderTo(dst string) []string {
 
 	e.vivFileDirs = []string{dst}
 
+	outputs, err := e.cachedRender()
+	if err != nil {
+		panic(err)
+	}
+
+	outputRealFilepath := make([]string, len(outputs))
+
+	for i, f := range outputs {
+		realfilepath := path.Join(dst, f.Name)
+		writeFile(realfilepath, f.Data)
+
+		outputRealFilepath[i] = realfilepath
+	}
+
+	return outputRealFilepath
+}
+
+// render renders the vivs to values files of the umbrella chart, named after their output file
+func (e *Engine) render() ([]*chart.File, error) {
+	if err := e.cfg.Settings.validate(); err != nil {
+		return nil, errors.Wrap(err, "viv settings")
+	}
+	if err := e.loadSettings(e.cfg.Chart); err != nil {
+		return nil, err
+	}
+	root, _ := e.settings(e.cfg.Chart)
+	if e.cfg.Env != "" && !e.hasEnvOverlay(e.cfg.Chart) {
+		return nil, errors.Errorf("viv env %q has no overlay, no chart has a %s directory", e.cfg.Env, root.envOverlay(e.cfg.Env))
+	}
+
+	r := e.renderer(root)
+	if err := e.evalConditions(r); err != nil {
+		return nil, err
+	}
+
 	outputFiles, err := e.eachChart(e.cfg.Chart, "")
 	if err != nil {
-		panic(errors.Wrap(err, "eachChart failed"))
+		return nil, errors.Wrap(err, "eachChart failed")
 	}
 
-	e.cfg.Chart.Templates = append(e.cfg.Chart.Templates, outputFiles...)
-	e.cfg.Chart.Files = append(e.cfg.Chart.Files, outputFiles...)
-	e.cfg.Chart.Raw = append(e.cfg.Chart.Raw, outputFiles...)
-	//
+	tmpls, err := e.renderVivs(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "vivs render failed")
+	}
 
-	tmpls, err := engine.Render(e.cfg.Chart, e.cfg.Values)
+	currentValues, _ := e.cfg.Values.Table("Values")
+	// resolved are the values with the outputs of the vivs rendered so far, like helm merges them
+	cp, err := copystructure.Copy(map[string]interface{}(currentValues))
 	if err != nil {
-		panic(errors.Wrap(err, "vivs render failed"))
+		return nil, errors.Wrap(err, "copy values")
 	}
+	resolved, _ := cp.(map[string]interface{})
 
-	outputRealFilepath := make([]string, len(outputFiles))
+	outputs := make([]*chart.File, len(outputFiles))
+	// output names keep the path of nested viv files, they collide only with underscores in names
+	sources := map[string]string{}
 
 	for i, f := range outputFiles {
-		filename := path.Join(e.cfg.Chart.Name(), f.Name)
-		realfilepath := path.Join(dst, strings.ReplaceAll(filename, "/", "_"))
+		filename := f.Name
 
-		newdata, err := addRootNode(getNode(f.Name), []byte(tmpls[filename]))
+		settings, _ := e.settings(f.chart)
+		newdata, err := output(getNode(f.chart.ChartFullPath()), f.Name, []byte(tmpls[filename]), resolved, settings.Precedence == PrecedenceValues)
 		if err != nil {
-			log.Println(tmpls[filename])
-			panic(errors.Wrap(err, fmt.Sprintf("file: %s", filename)))
+			e.log.Debug("viv output", "file", filename, "output", tmpls[filename])
+			return nil, errors.Wrap(err, fmt.Sprintf("file: %s", filename))
+		}
+		out := map[string]interface{}{}
+		if err := yaml.Unmarshal(newdata, &out); err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("file: %s", filename))
 		}
-		writeFile(realfilepath, newdata)
+		mergeResolved(resolved, out)
 
-		outputRealFilepath[i] = realfilepath
+		name := strings.ReplaceAll(filename, "/", "_")
+		if other, ok := sources[name]; ok {
+			return nil, errors.Errorf("viv files %s and %s have the same output name %s, rename one of them", other, filename, name)
+		}
+		sources[name] = filename
+		outputs[i] = &chart.File{Name: name, Data: newdata}
 	}
 
-	return outputRealFilepath
+	return outputs, nil
 }
 
+// renderer returns the template engine of the vivs
+func (e *Engine) renderer(root Settings) render.Engine {
+	return render.Engine{
+		Strict:        root.strict(),
+		Funcs:         e.funcs(),
+		TemplateFuncs: e.templateFuncs(),
+		SiteFuncs:     utils.IF(e.cfg.Deterministic && !e.cfg.ForbidNondeterministic, randomFuncs, nil),
+		RESTConfig:    utils.IF(e.cfg.Lookup == nil, e.cfg.RESTConfig, nil),
+	}
+}
+
+// EnvRead returns the environment variables vivs have read, for auditing
+func (e *Engine) EnvRead() []string {
+	return e.env.Read()
+}
+
+// RenderToTemp renders to a workspace of its own in the output dir of the umbrella chart settings,
+// vivTemp by default, so that concurrent runs on the same chart do not clash
 func (e *Engine) RenderToTemp() []string {
-	return e.RenderTo("vivTemp")
+	ws, err := e.workspace()
+	if err != nil {
+		panic(err)
+	}
+	return e.RenderTo(ws.dir)
 }
 
-func (e *Engine) eachChart(ch *chart.Chart, node string) ([]*chart.File, error) {
+func (e *Engine) eachChart(ch *chart.Chart, node string) ([]*vivFile, error) {
 
-	renderFiles := make([]*chart.File, 0)
+	renderFiles := make([]*vivFile, 0)
 
-	for _, f := range ch.Raw {
-		if !strings.HasPrefix(f.Name, "vivs/") || f.Name == "" || len(f.Data) == 0 {
+	for _, f := range e.vivFiles(ch) {
+		// partials define templates for the other vivs, they have no output
+		if strings.HasPrefix(path.Base(f.Name), "_") {
 			continue
 		}
-		f.Name = path.Join(ch.ChartFullPath()[len(e.cfg.Chart.Name()):], f.Name)
-		log.Printf("load viv files: %s", f.Name)
-		renderFiles = append(renderFiles, f)
+		name := path.Join(ch.ChartFullPath(), f.Name)
+		e.log.Debug("load viv file", "file", name)
+		renderFiles = append(renderFiles, &vivFile{File: &chart.File{Name: name, Data: f.Data}, chart: ch})
 	}
 
 	for _, d := range ch.Dependencies() {
@@ -100,7 +202,120 @@ func (e *Engine) eachChart(ch *chart.Chart, node string) ([]*chart.File, error)
 	return renderFiles, nil
 }
 
+// values returns the data of the vivs, the helm one with .Viv
+func (e *Engine) values() chartutil.Values {
+	values := chartutil.Values{}
+	for k, v := range e.cfg.Values {
+		values[k] = v
+	}
+	values["Viv"] = map[string]interface{}{"Env": e.cfg.Env}
+	return values
+}
+
+// funcs returns the functions vivs have on top of the helm ones
+func (e *Engine) funcs() template.FuncMap {
+	funcs := vivFuncs()
+	funcs["env"] = e.env.Getenv
+	if e.cfg.Lookup != nil {
+		funcs["lookup"] = e.cfg.Lookup
+	}
+	for name, fn := range e.cfg.Funcs {
+		funcs[name] = fn
+	}
+	return funcs
+}
+
+// templateFuncs returns the functions that depend on the viv file being rendered
+func (e *Engine) templateFuncs() func(name string) template.FuncMap {
+	if !e.cfg.Deterministic && !e.cfg.ForbidNondeterministic {
+		return nil
+	}
+
+	release, _ := e.cfg.Values.Table("Release")
+	d := newDeterminism(
+		fmt.Sprint(release["Name"]),
+		fmt.Sprint(release["Namespace"]),
+		e.cfg.Now,
+		e.cfg.ForbidNondeterministic,
+	)
+	return d.Funcs
+}
+
+// vivFiles returns the viv files of a chart to render, without the files skipped by their
+// when expression, and with blank lines in place of front matters
+func (e *Engine) vivFiles(ch *chart.Chart) []*chart.File {
+	files := make([]*chart.File, 0)
+	for _, f := range e.candidateFiles(ch) {
+		if e.skipped[path.Join(ch.ChartFullPath(), f.Name)] {
+			continue
+		}
+		if fm, body, err := splitFrontMatter(f.Data); err == nil && fm != nil {
+			f = &chart.File{Name: f.Name, Data: body}
+		}
+		files = append(files, f)
+	}
+	return files
+}
+
+// candidateFiles returns the viv files of a chart, without its dependencies and test cases,
+// in the order of its settings
+func (e *Engine) candidateFiles(ch *chart.Chart) []*chart.File {
+	settings, _ := e.settings(ch)
+
+	files := make([]*chart.File, 0)
+	overlays := make([]*chart.File, 0)
+	for _, f := range ch.Raw {
+		if len(f.Data) == 0 {
+			continue
+		}
+		if settings.isVivFile(f.Name) {
+			files = append(files, f)
+		} else if e.cfg.Env != "" && strings.HasPrefix(f.Name, settings.envOverlay(e.cfg.Env)) {
+			overlays = append(overlays, f)
+		}
+	}
+
+	rank := func(f *chart.File) int {
+		for i, name := range settings.Order {
+			if path.Join(settings.VivDir, name) == f.Name {
+				return i
+			}
+		}
+		return len(settings.Order)
+	}
+	for _, group := range [][]*chart.File{files, overlays} {
+		sort.SliceStable(group, func(i, j int) bool {
+			if ri, rj := rank(group[i]), rank(group[j]); ri != rj {
+				return ri < rj
+			}
+			return group[i].Name < group[j].Name
+		})
+	}
+	// the overlay of the environment is applied on top of the base vivs
+	return append(files, overlays...)
+}
+
+// hasEnvOverlay reports whether the chart or one of its dependencies has an overlay for Config.Env
+func (e *Engine) hasEnvOverlay(ch *chart.Chart) bool {
+	settings, _ := e.settings(ch)
+	for _, f := range ch.Raw {
+		if strings.HasPrefix(f.Name, settings.envOverlay(e.cfg.Env)) {
+			return true
+		}
+	}
+	for _, d := range ch.Dependencies() {
+		if e.hasEnvOverlay(d) {
+			return true
+		}
+	}
+	return false
+}
+
 func (e *Engine) Clear() {
+	if e.ws != nil {
+		e.ws.remove()
+		e.ws = nil
+	}
 	if e.vivFileDirs != nil && len(e.vivFileDirs) > 0 {
 		for _, dir := range e.vivFileDirs {
 			_ = os.RemoveAll(dir)
@@ -108,7 +323,29 @@ func (e *Engine) Clear() {
 	}
 }
 
-func addRootNode(root string, data []byte) ([]byte, error) {
+// output turns a rendered viv into a values file of the umbrella chart
+// node is the path of the chart in the values of the umbrella chart, e.g. .child.
+// resolved are the values with the outputs of the previous vivs, that directives and patches apply to.
+// fillOnly applies every key only when it is empty, on top of .default.yaml files.
+func output(node, name string, data []byte, resolved chartutil.Values, fillOnly bool) ([]byte, error) {
+	if isPatch(name) {
+		scoped, _ := resolved.Table(strings.TrimPrefix(node, "."))
+		if node == "" {
+			scoped = resolved
+		}
+		data, err := applyPatch(data, scoped)
+		if err != nil {
+			return nil, err
+		}
+		return addRootNode(node, data, nil)
+	}
+
+	return addRootNode(node, data, func(data map[string]interface{}) (map[string]interface{}, error) {
+		return resolveDirectives(data, resolved, fillOnly || isFillOnly(name))
+	})
+}
+
+func addRootNode(root string, data []byte, resolve func(map[string]interface{}) (map[string]interface{}, error)) ([]byte, error) {
 	current, _ := newTree(nil)
 	nodes := strings.Split(root, ".")
 	for i := 0; i < len(nodes); i++ {
@@ -122,7 +359,23 @@ func addRootNode(root string, data []byte) ([]byte, error) {
 		return data, err
 	}
 
-	return current.Top().MarshalWithYAML()
+	top := current.Top()
+
+	// subchart vivs may emit into global, which belongs to the umbrella chart
+	if global, ok := current.data[globalKey]; ok && current != top {
+		delete(current.data, globalKey)
+		top.data[globalKey] = global
+	}
+
+	if resolve != nil {
+		resolved, err := resolve(top.data)
+		if err != nil {
+			return data, err
+		}
+		top.data = resolved
+	}
+
+	return top.MarshalWithYAML()
 }
 
 func writeFile(filepath string, data []byte) {
@@ -137,6 +390,8 @@ func writeFile(filepath string, data []byte) {
 	}
 }
 
+const globalKey = "global"
+
 var partten = "charts/([a-zA-Z]+[a-zA-Z0-9]+)"
 
 func getNode(name string) string {
@@ -1,11 +1,881 @@
 package engine
 
 import (
+	"bytes"
+	"github.com/lazychanger/helm-variable-in-values/pkg/render"
 	"github.com/stretchr/testify/assert"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"os"
+	"path"
+	"sigs.k8s.io/yaml"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestGetNodes(t *testing.T) {
 	assert.Equal(t, getNode("simple-example/charts/ingressAlias/charts/service/vivs/values.yaml"), ".ingressAlias.service")
 	assert.Equal(t, getNode("simple-example/charts/ingressAlias/vivs/values.yaml"), ".ingressAlias")
 }
+
+func TestResolveDefaults(t *testing.T) {
+	current := map[string]interface{}{
+		"name": "",
+		"selector": map[string]interface{}{
+			"name": "user",
+			"port": nil,
+		},
+		"replicas": 0,
+	}
+
+	viv := map[string]interface{}{
+		"name":     map[string]interface{}{"$default": "viv"},
+		"replicas": map[string]interface{}{"$default": 3},
+		"selector": map[string]interface{}{
+			"name": map[string]interface{}{"$default": "viv"},
+			"port": 80,
+		},
+	}
+	assert.Equal(t, map[string]interface{}{
+		"name":     "viv",
+		"selector": map[string]interface{}{"port": 80},
+	}, mustResolve(t, viv, current, false))
+
+	viv = map[string]interface{}{
+		"name":     "viv",
+		"replicas": 3,
+		"selector": map[string]interface{}{"name": "viv", "port": 80},
+		"extra":    true,
+	}
+	assert.Equal(t, map[string]interface{}{
+		"name":     "viv",
+		"selector": map[string]interface{}{"port": 80},
+		"extra":    true,
+	}, mustResolve(t, viv, current, true))
+
+	assert.True(t, isFillOnly("simple-example/vivs/serviceAccount.default.yaml"))
+	assert.False(t, isFillOnly("simple-example/vivs/values.yaml"))
+}
+
+func TestResolveListDirectives(t *testing.T) {
+	current := map[string]interface{}{
+		"args":        []interface{}{"--a"},
+		"annotations": map[string]interface{}{"a": "b"},
+		"containers": []interface{}{
+			map[string]interface{}{"name": "app", "image": "nginx", "port": 80},
+		},
+	}
+
+	viv := map[string]interface{}{
+		"args":        map[string]interface{}{"$append": []interface{}{"--b"}, "$prepend": []interface{}{"--c"}},
+		"annotations": map[string]interface{}{"$delete": true},
+		"labels":      map[string]interface{}{"$delete": true},
+		"containers": map[string]interface{}{
+			"$mergeBy": "name",
+			"$items": []interface{}{
+				map[string]interface{}{"name": "app", "image": "busybox"},
+				map[string]interface{}{"name": "sidecar", "image": "envoy"},
+			},
+		},
+	}
+	assert.Equal(t, map[string]interface{}{
+		"args":        []interface{}{"--c", "--a", "--b"},
+		"annotations": nil,
+		"containers": []interface{}{
+			map[string]interface{}{"name": "app", "image": "busybox", "port": 80},
+			map[string]interface{}{"name": "sidecar", "image": "envoy"},
+		},
+	}, mustResolve(t, viv, current, false))
+	assert.Equal(t, "nginx", current["containers"].([]interface{})[0].(map[string]interface{})["image"])
+
+	_, err := resolveDirectives(map[string]interface{}{
+		"annotations": map[string]interface{}{"$append": []interface{}{"x"}},
+	}, current, false)
+	assert.EqualError(t, err, "annotations: $append needs a list, got map[string]interface {}")
+
+	_, err = resolveDirectives(map[string]interface{}{
+		"args": map[string]interface{}{"$append": []interface{}{"x"}, "name": "x"},
+	}, current, false)
+	assert.EqualError(t, err, "args: directive $append can not be mixed with values")
+}
+
+func TestDeleteDirective(t *testing.T) {
+	root := &chart.Chart{
+		Metadata: &chart.Metadata{Name: "root", Version: "0.1.0"},
+		Raw: []*chart.File{
+			{Name: "vivs/a.yaml", Data: []byte("added: 1\nsub:\n  fromParent: 1")},
+			{Name: "vivs/b.yaml", Data: []byte("added:\n  $delete: true\nmissing:\n  $delete: true")},
+		},
+	}
+	root.AddDependency(&chart.Chart{
+		Metadata: &chart.Metadata{Name: "sub", Version: "0.1.0"},
+		Raw:      []*chart.File{{Name: "vivs/values.yaml", Data: []byte("fromParent:\n  $delete: true")}},
+	})
+
+	outputs, err := NewEngine(&Config{Values: chartutil.Values{"Values": map[string]interface{}{}}, Chart: root}).render()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(outputs))
+	// a key set by a previous viv is deleted, a key set nowhere is left out
+	assert.Equal(t, "added: null\n", string(outputs[1].Data))
+	// a subchart deletes a key its parent viv set
+	assert.Equal(t, "sub:\n  fromParent: null\n", string(outputs[2].Data))
+}
+
+func TestListDirectivesChain(t *testing.T) {
+	root := &chart.Chart{
+		Metadata: &chart.Metadata{Name: "root", Version: "0.1.0"},
+		Raw: []*chart.File{
+			{Name: "vivs/a.yaml", Data: []byte("ports:\n  $append: [b]\nname: a")},
+			{Name: "vivs/b.yaml", Data: []byte("ports:\n  $append: [c]")},
+			{Name: "vivs/c.default.yaml", Data: []byte("name: c\nports: [d]")},
+		},
+	}
+	values := chartutil.Values{"Values": map[string]interface{}{"ports": []interface{}{"a"}}}
+
+	outputs, err := NewEngine(&Config{Values: values, Chart: root}).render()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(outputs))
+	// the second viv appends to the list of the first one, helm replaces lists as a whole
+	assert.Equal(t, "ports:\n- a\n- b\n- c\n", string(outputs[1].Data))
+	// keys filled by a previous viv are not empty anymore
+	assert.Equal(t, "{}\n", string(outputs[2].Data))
+}
+
+func mustResolve(t *testing.T, viv, current map[string]interface{}, fillOnly bool) map[string]interface{} {
+	out, err := resolveDirectives(viv, current, fillOnly)
+	assert.NoError(t, err)
+	return out
+}
+
+func TestApplyPatch(t *testing.T) {
+	current := map[string]interface{}{
+		"hosts": []interface{}{"a", "c"},
+		"tls":   map[string]interface{}{"enabled": true, "secret": "x"},
+	}
+
+	out, err := applyPatch([]byte(`
+- op: add
+  path: /hosts/1
+  value: b
+- op: test
+  path: /tls/enabled
+  value: true
+- op: remove
+  path: /tls/secret
+`), current)
+	assert.NoError(t, err)
+	assert.Equal(t, "hosts:\n- a\n- b\n- c\ntls:\n  secret: null\n", string(out))
+
+	out, err = applyPatch([]byte("tls:\n  enabled: false\n  secret: null\n"), current)
+	assert.NoError(t, err)
+	assert.Equal(t, "tls:\n  enabled: false\n  secret: null\n", string(out))
+
+	_, err = applyPatch([]byte(`[{"op": "replace", "path": "/missing/0", "value": 1}]`), current)
+	assert.ErrorContains(t, err, "json patch operation #0 (replace /missing/0)")
+
+	assert.True(t, isPatch("simple-example/vivs/hosts.patch.yaml"))
+	assert.True(t, isPatch("simple-example/vivs/hosts.jsonpatch"))
+	assert.False(t, isPatch("simple-example/vivs/values.yaml"))
+}
+
+func TestPatchAfterViv(t *testing.T) {
+	root := &chart.Chart{
+		Metadata: &chart.Metadata{Name: "root", Version: "0.1.0"},
+		Raw: []*chart.File{
+			{Name: "vivs/a.yaml", Data: []byte("hosts: [a, b]\ntls:\n  enabled: true")},
+			{Name: "vivs/b.patch.yaml", Data: []byte("- op: test\n  path: /tls/enabled\n  value: true\n- op: add\n  path: /hosts/-\n  value: c")},
+		},
+	}
+	values := chartutil.Values{"Values": map[string]interface{}{"hosts": []interface{}{"a"}}}
+
+	outputs, err := NewEngine(&Config{Values: values, Chart: root}).render()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(outputs))
+	// the patch applies to the list the previous viv set, and sees its values
+	assert.Equal(t, "hosts:\n- a\n- b\n- c\n", string(outputs[1].Data))
+}
+
+func TestEnvAccess(t *testing.T) {
+	t.Setenv("CI_BUILD_NUMBER", "42")
+	t.Setenv("SECRET_TOKEN", "secret")
+
+	env := newEnvAccess([]string{"CI_*", "GIT_SHA"})
+
+	v, err := env.Getenv("CI_BUILD_NUMBER")
+	assert.NoError(t, err)
+	assert.Equal(t, "42", v)
+
+	v, err = env.Getenv("GIT_SHA")
+	assert.NoError(t, err)
+	assert.Equal(t, "", v)
+
+	_, err = env.Getenv("SECRET_TOKEN")
+	assert.Error(t, err)
+
+	assert.Equal(t, []string{"CI_BUILD_NUMBER", "GIT_SHA"}, env.Read())
+}
+
+func TestVivFuncs(t *testing.T) {
+	dnsName := func(name string, maxLen ...int) string {
+		label, err := vivDNSName(name, maxLen...)
+		assert.NoError(t, err)
+		return label
+	}
+	assert.Equal(t, "my-release-worker", dnsName("My_Release.Worker"))
+	long := dnsName(strings.Repeat("a", 70))
+	assert.Len(t, long, 63)
+	assert.NotEqual(t, long, dnsName(strings.Repeat("a", 70)+"b"))
+	assert.Len(t, dnsName(strings.Repeat("a", 30), 20), 20)
+	_, err := vivDNSName("__.__")
+	assert.ErrorContains(t, err, "has no valid DNS label character")
+
+	assert.Equal(t, "svc.prod.svc.cluster.local", vivServiceFQDN("svc", "prod"))
+	assert.Equal(t, "svc.default.svc.example.org", vivServiceFQDN("svc", "", "example.org."))
+
+	values := map[string]interface{}{
+		"ingress": map[string]interface{}{
+			"hosts": []interface{}{map[string]interface{}{"host": "a.local"}},
+		},
+	}
+	assert.Equal(t, "a.local", vivGet(values, "ingress.hosts.0.host"))
+	assert.Equal(t, "def", vivGet(values, "ingress.hosts.1.host", "def"))
+	assert.Nil(t, vivGet(values, "ingress.tls"))
+
+	ctx := map[string]interface{}{
+		"Release": map[string]interface{}{"Name": "rel"},
+		"Subcharts": map[string]interface{}{
+			"ingressAlias": map[string]interface{}{
+				"Chart":  struct{ Name string }{"ingress"},
+				"Values": map[string]interface{}{"nameOverride": ""},
+			},
+		},
+	}
+	name, err := vivSubchartFullname(ctx, "ingressAlias")
+	assert.NoError(t, err)
+	assert.Equal(t, "rel-ingress", name)
+
+	_, err = vivSubchartFullname(ctx, "missing")
+	assert.Error(t, err)
+}
+
+func TestDeterminism(t *testing.T) {
+	renderWith := func(release string, forbid bool, viv string) (string, error) {
+		c := &chart.Chart{
+			Metadata: &chart.Metadata{Name: "det", Version: "0.1.0"},
+			Raw:      []*chart.File{{Name: "vivs/values.yaml", Data: []byte(viv)}},
+		}
+		d := newDeterminism(release, "default", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), forbid)
+		out, err := render.Engine{TemplateFuncs: d.Funcs, SiteFuncs: randomFuncs}.Render(c, chartutil.Values{}, NewEngine(&Config{Chart: c}).vivFiles)
+		return out["det/vivs/values.yaml"], err
+	}
+
+	viv := `{{ randAlphaNum 16 }}-{{ uuidv4 }}-{{ now | date "2006" }}`
+	first, err := renderWith("rel", false, viv)
+	assert.NoError(t, err)
+	second, _ := renderWith("rel", false, viv)
+	other, _ := renderWith("rel2", false, viv)
+	assert.Equal(t, first, second)
+	assert.NotEqual(t, first, other)
+	assert.Regexp(t, "^[a-zA-Z0-9]{16}-[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}-2020$", first)
+
+	// values are seeded per call site, a new call does not change the others
+	values := func(viv string) map[string]interface{} {
+		out, err := renderWith("rel", false, viv)
+		assert.NoError(t, err)
+		vals := map[string]interface{}{}
+		assert.NoError(t, yaml.Unmarshal([]byte(out), &vals))
+		return vals
+	}
+	before := values("db:\n  password: {{ randAlphaNum 16 }}\napi:\n  key: {{ randAlphaNum 16 }}\n")
+	after := values("token: {{ randAlphaNum 16 }}\ndb:\n  user: {{ randAlpha 4 }}\n  password: {{ randAlphaNum 16 }}\napi:\n  key: {{ randAlphaNum 16 }}\n")
+	assert.Equal(t, before["db"].(map[string]interface{})["password"], after["db"].(map[string]interface{})["password"])
+	assert.Equal(t, before["api"], after["api"])
+	assert.NotEqual(t, before["db"].(map[string]interface{})["password"], before["api"].(map[string]interface{})["key"])
+
+	loop := values("ids:\n{{- range until 2 }}\n  - {{ randNumeric 8 | quote }}\n{{- end }}\n")
+	assert.NotEqual(t, loop["ids"].([]interface{})[0], loop["ids"].([]interface{})[1])
+
+	_, err = renderWith("rel", true, viv)
+	assert.ErrorContains(t, err, "randAlphaNum is not deterministic")
+}
+
+func TestLookupFixtures(t *testing.T) {
+	f, err := LoadLookupFixtures("../../example/lookup-fixtures")
+	assert.NoError(t, err)
+
+	secret, err := f.Lookup("v1", "Secret", "default", "release-name-auth")
+	assert.NoError(t, err)
+	assert.Equal(t, "c2VjcmV0", vivGet(secret, "data.password"))
+
+	missing, err := f.Lookup("v1", "Secret", "other", "release-name-auth")
+	assert.NoError(t, err)
+	assert.Empty(t, missing)
+
+	list, err := f.Lookup("v1", "ConfigMap", "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "ConfigMapList", list["kind"])
+	assert.Len(t, list["items"], 1)
+
+	// vivs can change the objects they get, the fixtures are not changed
+	secret["data"].(map[string]interface{})["password"] = "changed"
+	list["items"].([]interface{})[0].(map[string]interface{})["data"] = nil
+	secret, _ = f.Lookup("v1", "Secret", "default", "release-name-auth")
+	assert.Equal(t, "c2VjcmV0", vivGet(secret, "data.password"))
+	list, _ = f.Lookup("v1", "ConfigMap", "", "")
+	assert.Equal(t, "production", vivGet(list["items"].([]interface{})[0].(map[string]interface{}), "data.mode"))
+
+	// objects without a namespace match every namespace
+	f.objects = append(f.objects, map[string]interface{}{"apiVersion": "v1", "kind": "Secret", "metadata": map[string]interface{}{"name": "plain"}})
+	plain, err := f.Lookup("v1", "Secret", "other", "plain")
+	assert.NoError(t, err)
+	assert.Equal(t, "plain", vivGet(plain, "metadata.name"))
+}
+
+func TestRenderCache(t *testing.T) {
+	c := &chart.Chart{
+		Metadata: &chart.Metadata{Name: "cached", Version: "0.1.0"},
+		Raw: []*chart.File{
+			{Name: "vivs/values.yaml", Data: []byte(`calls: {{ count }}`)},
+		},
+	}
+	calls := 0
+	cacheDir := t.TempDir()
+	newEngine := func(values map[string]interface{}, build string) *Engine {
+		return NewEngine(&Config{
+			WorkDir:      t.TempDir(),
+			Values:       chartutil.Values{"Values": values},
+			Chart:        c,
+			Funcs:        map[string]interface{}{"count": func() int { calls++; return calls }},
+			CacheDir:     cacheDir,
+			BuildVersion: build,
+		})
+	}
+
+	readAll := func(files []string) string {
+		out := ""
+		for _, f := range files {
+			data, _ := os.ReadFile(f)
+			out += string(data)
+		}
+		return out
+	}
+
+	assert.Equal(t, "calls: 1\n", readAll(newEngine(map[string]interface{}{"a": 1}, "v1").RenderToTemp()))
+	assert.Equal(t, "calls: 1\n", readAll(newEngine(map[string]interface{}{"a": 1}, "v1").RenderToTemp()))
+	assert.Equal(t, "calls: 2\n", readAll(newEngine(map[string]interface{}{"a": 2}, "v1").RenderToTemp()))
+	// another build does not reuse the outputs
+	assert.Equal(t, "calls: 3\n", readAll(newEngine(map[string]interface{}{"a": 2}, "v2").RenderToTemp()))
+
+	entries, _ := os.ReadDir(cacheDir)
+	assert.Len(t, entries, 3)
+	for _, entry := range entries {
+		info, _ := entry.Info()
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+}
+
+func TestRenderConcurrency(t *testing.T) {
+	newChart := func(name, viv string) *chart.Chart {
+		return &chart.Chart{
+			Metadata: &chart.Metadata{Name: name, Version: "0.1.0"},
+			Raw:      []*chart.File{{Name: "vivs/values.yaml", Data: []byte(viv)}},
+		}
+	}
+	newEngine := func(vivs ...string) *Engine {
+		root := newChart("root", vivs[0])
+		for i, viv := range vivs[1:] {
+			root.AddDependency(newChart("sub"+string(rune('a'+i)), viv))
+		}
+		return NewEngine(&Config{
+			Values:      chartutil.Values{"Values": map[string]interface{}{}},
+			Chart:       root,
+			Concurrency: 3,
+		})
+	}
+
+	outputs, err := newEngine(`name: {{ .Chart.Name }}`, `name: {{ .Chart.Name }}`, `name: {{ .Chart.Name }}`, `name: {{ .Chart.Name }}`).render()
+	assert.Nil(t, err)
+	names := make([]string, 0)
+	for _, f := range outputs {
+		names = append(names, f.Name+"="+strings.TrimSpace(string(f.Data)))
+	}
+	assert.Equal(t, []string{
+		"root_vivs_values.yaml=name: root",
+		"root_charts_suba_vivs_values.yaml=suba:\n  name: suba",
+		"root_charts_subb_vivs_values.yaml=subb:\n  name: subb",
+		"root_charts_subc_vivs_values.yaml=subc:\n  name: subc",
+	}, names)
+
+	_, err = newEngine(`ok: true`, `{{ fail "suba failed" }}`, `ok: true`, `{{ fail "subc failed" }}`).render()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "suba failed")
+	assert.Contains(t, err.Error(), "subc failed")
+}
+
+func TestExport(t *testing.T) {
+	root := &chart.Chart{
+		Metadata: &chart.Metadata{Name: "root", Version: "0.1.0"},
+		Raw: []*chart.File{
+			{Name: "vivs/a.yaml", Data: []byte("b: 1\na: {x: 1, z: 1}")},
+			{Name: "vivs/b.yaml", Data: []byte("a: {z: 2}")},
+		},
+	}
+	root.AddDependency(&chart.Chart{
+		Metadata: &chart.Metadata{Name: "sub", Version: "0.1.0"},
+		Raw:      []*chart.File{{Name: "vivs/values.yaml", Data: []byte("name: sub")}},
+	})
+	e := NewEngine(&Config{Values: chartutil.Values{"Values": map[string]interface{}{}}, Chart: root})
+
+	dst := t.TempDir()
+	manifest, err := e.Export(dst, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(manifest.Files))
+	assert.Equal(t, "root.yaml", manifest.Files[0].Path)
+	assert.Equal(t, "root/vivs/a.yaml", manifest.Files[0].Sources[0].Path)
+	assert.Equal(t, "root/vivs/b.yaml", manifest.Files[0].Sources[1].Path)
+	assert.Equal(t, "root_charts_sub.yaml", manifest.Files[1].Path)
+
+	data, _ := os.ReadFile(path.Join(dst, "root.yaml"))
+	assert.Equal(t, "a:\n  x: 1\n  z: 2\nb: 1\n", string(data))
+
+	dst = t.TempDir()
+	manifest, err = e.Export(dst, true)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(manifest.Files))
+	assert.Equal(t, 3, len(manifest.Files[0].Sources))
+	data, _ = os.ReadFile(path.Join(dst, "values.yaml"))
+	assert.Equal(t, "a:\n  x: 1\n  z: 2\nb: 1\nsub:\n  name: sub\n", string(data))
+	_, err = os.Stat(path.Join(dst, "manifest.yaml"))
+	assert.Nil(t, err)
+
+	// the second export reads the outputs from the cache
+	cacheDir := t.TempDir()
+	for i := 0; i < 2; i++ {
+		e = NewEngine(&Config{Values: chartutil.Values{"Values": map[string]interface{}{}}, Chart: root, CacheDir: cacheDir})
+		dst = t.TempDir()
+		manifest, err = e.Export(dst, false)
+		assert.Nil(t, err)
+		assert.Equal(t, "root_charts_sub.yaml", manifest.Files[1].Path)
+		data, _ = os.ReadFile(path.Join(dst, "root.yaml"))
+		assert.Equal(t, "a:\n  x: 1\n  z: 2\nb: 1\n", string(data))
+	}
+}
+
+func TestExportSkipped(t *testing.T) {
+	root := &chart.Chart{
+		Metadata: &chart.Metadata{Name: "root", Version: "0.1.0"},
+		Raw: []*chart.File{
+			{Name: "vivs/a.yaml", Data: []byte("---\nwhen: .Values.tls\n---\ntls: on")},
+			{Name: "vivs/b.yaml", Data: []byte("b: 1")},
+		},
+	}
+
+	cacheDir := t.TempDir()
+	for i := 0; i < 2; i++ {
+		e := NewEngine(&Config{Values: chartutil.Values{"Values": map[string]interface{}{"tls": false}}, Chart: root, CacheDir: cacheDir})
+		dst := t.TempDir()
+		manifest, err := e.Export(dst, false)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(manifest.Files))
+		assert.Equal(t, 1, len(manifest.Files[0].Sources))
+		assert.Equal(t, "root/vivs/b.yaml", manifest.Files[0].Sources[0].Path)
+		data, _ := os.ReadFile(path.Join(dst, "root.yaml"))
+		assert.Equal(t, "b: 1\n", string(data))
+	}
+}
+
+func TestRunTests(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"Chart.yaml":               "apiVersion: v2\nname: tested\nversion: 0.1.0\n",
+		"values.yaml":              "replicas: 1\n",
+		"vivs/values.yaml":         "name: '{{ .Release.Name }}-{{ .Values.replicas }}'\n",
+		"vivs/tests/asserts.yaml":  "release: {name: demo}\nvalues: {replicas: 2}\nasserts:\n- path: name\n  equals: demo-2\n",
+		"vivs/tests/expected.yaml": "expected: {name: release-name-3}\n",
+		"vivs/tests/golden.yaml":   "release: {name: golden}\n",
+	}
+	for name, data := range files {
+		assert.Nil(t, os.MkdirAll(path.Dir(path.Join(dir, name)), 0755))
+		assert.Nil(t, os.WriteFile(path.Join(dir, name), []byte(data), 0644))
+	}
+
+	results, err := RunTests(dir, TestOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(results))
+	assert.True(t, results[0].Passed())
+	assert.Contains(t, results[1].Failures[0], "-name: release-name-3\n+name: release-name-1")
+	assert.Contains(t, results[2].Failures[0], "no golden file")
+
+	results, err = RunTests(dir, TestOptions{Update: true})
+	assert.Nil(t, err)
+	assert.True(t, results[2].Updated)
+	golden, _ := os.ReadFile(path.Join(dir, "vivs/tests/golden/golden.yaml"))
+	assert.Equal(t, "name: golden-1\n", string(golden))
+
+	results, err = RunTests(dir, TestOptions{})
+	assert.Nil(t, err)
+	assert.True(t, results[2].Passed())
+}
+
+func TestSettings(t *testing.T) {
+	newChart := func(settings string) *chart.Chart {
+		return &chart.Chart{
+			Metadata: &chart.Metadata{Name: "configured", Version: "0.1.0"},
+			Raw: []*chart.File{
+				{Name: "viv.yaml", Data: []byte(settings)},
+				{Name: "config/a.yaml", Data: []byte("name: a\nreplicas: 2")},
+				{Name: "config/b.yaml", Data: []byte("name: b")},
+				{Name: "vivs/ignored.yaml", Data: []byte("ignored: true")},
+			},
+		}
+	}
+	renderWith := func(settings string, override Settings) ([]*chart.File, error) {
+		return NewEngine(&Config{
+			Values:   chartutil.Values{"Values": map[string]interface{}{"replicas": 1}},
+			Chart:    newChart(settings),
+			Settings: override,
+		}).render()
+	}
+
+	outputs, err := renderWith("vivDir: config\norder: [b.yaml]\n", Settings{})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(outputs))
+	assert.Equal(t, "configured_config_b.yaml", outputs[0].Name)
+	assert.Equal(t, "configured_config_a.yaml", outputs[1].Name)
+
+	outputs, err = renderWith("vivDir: config\nprecedence: values\n", Settings{})
+	assert.Nil(t, err)
+	assert.Equal(t, "name: a\n", string(outputs[0].Data))
+
+	outputs, err = renderWith("vivDir: config\n", Settings{VivDir: "vivs"})
+	assert.Nil(t, err)
+	assert.Equal(t, "configured_vivs_ignored.yaml", outputs[0].Name)
+
+	_, err = renderWith("vivDirs: config\n", Settings{})
+	assert.Contains(t, err.Error(), `unknown field "vivDirs"`)
+	_, err = renderWith("precedence: user\n", Settings{})
+	assert.Contains(t, err.Error(), "precedence")
+
+	c := newChart("vivDir: config\n")
+	c.Metadata.Annotations = map[string]string{SettingsAnnotation: "vivDir: vivs"}
+	_, err = NewEngine(&Config{Chart: c}).settings(c)
+	assert.NotNil(t, err)
+}
+
+func TestVivFilePatterns(t *testing.T) {
+	c := &chart.Chart{
+		Metadata: &chart.Metadata{Name: "globbed", Version: "0.1.0"},
+		Raw: []*chart.File{
+			{Name: "vivs/values.yaml", Data: []byte("a: 1")},
+			{Name: "vivs/db/values.yaml", Data: []byte("b: 1")},
+			{Name: "vivs/experimental/values.yaml", Data: []byte("c: 1")},
+			{Name: "extra/values.yaml", Data: []byte("d: 1")},
+		},
+	}
+	names := func(s Settings) []string {
+		e := NewEngine(&Config{Chart: c, Settings: s})
+		out := make([]string, 0)
+		for _, f := range e.vivFiles(c) {
+			out = append(out, f.Name)
+		}
+		return out
+	}
+
+	assert.Equal(t, []string{"vivs/db/values.yaml", "vivs/experimental/values.yaml", "vivs/values.yaml"}, names(Settings{}))
+	assert.Equal(t, []string{"extra/values.yaml", "vivs/db/values.yaml", "vivs/values.yaml"},
+		names(Settings{Files: []string{"vivs/**/*.yaml", "extra/*.yaml", "!vivs/experimental/**"}}))
+
+	// the manifest patches dir is not a viv dir, it can be moved
+	c.Raw = append(c.Raw, &chart.File{Name: "vivs/patches/values.yaml", Data: []byte("f: 1")})
+	assert.Equal(t, []string{"vivs/db/values.yaml", "vivs/experimental/values.yaml", "vivs/values.yaml"}, names(Settings{}))
+	assert.Equal(t, []string{"vivs/db/values.yaml", "vivs/experimental/values.yaml", "vivs/patches/values.yaml", "vivs/values.yaml"},
+		names(Settings{PatchesDir: "manifest-patches"}))
+	assert.Error(t, Settings{PatchesDir: "../patches"}.validate())
+	c.Raw = c.Raw[:len(c.Raw)-1]
+
+	outputs, err := NewEngine(&Config{Values: chartutil.Values{}, Chart: c}).render()
+	assert.Nil(t, err)
+	assert.Equal(t, "globbed_vivs_db_values.yaml", outputs[0].Name)
+
+	// partials are included by the other vivs, they have no output
+	c.Raw = append(c.Raw, &chart.File{Name: "vivs/_helpers.tpl", Data: []byte(`{{ define "globbed.g" }}g: 1{{ end }}`)},
+		&chart.File{Name: "vivs/partial.yaml", Data: []byte(`{{ include "globbed.g" . }}`)})
+	outputs, err = NewEngine(&Config{Values: chartutil.Values{}, Chart: c}).render()
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(outputs))
+	assert.Equal(t, "globbed_vivs_partial.yaml", outputs[2].Name)
+	assert.Equal(t, "g: 1\n", string(outputs[2].Data))
+	c.Raw = c.Raw[:len(c.Raw)-2]
+
+	c.Raw = append(c.Raw, &chart.File{Name: "vivs/db_values.yaml", Data: []byte("e: 1")})
+	_, err = NewEngine(&Config{Values: chartutil.Values{}, Chart: c}).render()
+	assert.Contains(t, err.Error(), "same output name")
+}
+
+func TestEnvOverlay(t *testing.T) {
+	c := &chart.Chart{
+		Metadata: &chart.Metadata{Name: "envs", Version: "0.1.0"},
+		Raw: []*chart.File{
+			{Name: "vivs/values.yaml", Data: []byte("env: '{{ .Viv.Env }}'\nreplicas: 1")},
+			{Name: "vivs/_env/prod/values.yaml", Data: []byte("replicas: 3")},
+		},
+	}
+	renderEnv := func(env string) ([]*chart.File, error) {
+		return NewEngine(&Config{Values: chartutil.Values{}, Chart: c, Env: env}).render()
+	}
+
+	outputs, err := renderEnv("")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(outputs))
+	assert.Equal(t, "env: \"\"\nreplicas: 1\n", string(outputs[0].Data))
+
+	outputs, err = renderEnv("prod")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(outputs))
+	assert.Equal(t, "env: prod\nreplicas: 1\n", string(outputs[0].Data))
+	assert.Equal(t, "envs_vivs__env_prod_values.yaml", outputs[1].Name)
+	assert.Equal(t, "replicas: 3\n", string(outputs[1].Data))
+
+	_, err = renderEnv("staging")
+	assert.Contains(t, err.Error(), `viv env "staging" has no overlay`)
+}
+
+func TestWhen(t *testing.T) {
+	c := &chart.Chart{
+		Metadata: &chart.Metadata{Name: "when", Version: "0.1.0"},
+		Raw: []*chart.File{
+			{Name: "vivs/base.yaml", Data: []byte("name: base")},
+			{Name: "vivs/tls.yaml", Data: []byte("---\nwhen: .Values.tls.enabled\n---\ntls:\n  secretName: '{{ .Release.Name }}-tls'")},
+		},
+	}
+	renderTLS := func(enabled bool) ([]*chart.File, error) {
+		return NewEngine(&Config{
+			Values: chartutil.Values{
+				"Values":  map[string]interface{}{"tls": map[string]interface{}{"enabled": enabled}},
+				"Release": map[string]interface{}{"Name": "demo"},
+			},
+			Chart: c,
+		}).render()
+	}
+
+	outputs, err := renderTLS(false)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(outputs))
+
+	outputs, err = renderTLS(true)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(outputs))
+	assert.Equal(t, "tls:\n  secretName: demo-tls\n", string(outputs[1].Data))
+
+	fm, body, err := splitFrontMatter([]byte("---\nwhen: true\n---\n{{ fail }}"))
+	assert.Nil(t, err)
+	assert.Equal(t, "true", fm.When)
+	assert.Equal(t, "\n\n\n{{ fail }}", string(body))
+
+	_, _, err = splitFrontMatter([]byte("---\nwhen: true\nif: true\n---\n"))
+	assert.NotNil(t, err)
+
+	// a multi-document viv is not a front matter
+	multi := []byte("---\nname: first\n---\nname: second\n")
+	fm, body, err = splitFrontMatter(multi)
+	assert.Nil(t, err)
+	assert.Nil(t, fm)
+	assert.Equal(t, string(multi), string(body))
+}
+
+func TestPackage(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"Chart.yaml":           "apiVersion: v2\nname: baked\nversion: 0.1.0\n",
+		"values.yaml":          "replicas: 1\npodAnnotations: {a: b}\n",
+		"viv.yaml":             "precedence: viv\n",
+		"templates/cm.yaml":    "name: {{ .Values.name }}\n",
+		"vivs/values.yaml":     "name: '{{ .Release.Name }}-{{ .Values.replicas }}'\npodAnnotations:\n  $delete: true\n",
+		"vivs/tests/case.yaml": "release: {name: demo}\n",
+	}
+	for name, data := range files {
+		assert.Nil(t, os.MkdirAll(path.Dir(path.Join(dir, name)), 0755))
+		assert.Nil(t, os.WriteFile(path.Join(dir, name), []byte(data), 0644))
+	}
+	ch, err := loader.Load(dir)
+	assert.Nil(t, err)
+
+	values := chartutil.Values{
+		"Values":  map[string]interface{}{"replicas": 2, "podAnnotations": map[string]interface{}{"a": "b"}},
+		"Release": map[string]interface{}{"Name": "demo"},
+	}
+	archive, err := NewEngine(&Config{WorkDir: dir, Values: values, Chart: ch}).Package(t.TempDir())
+	assert.Nil(t, err)
+
+	baked, err := loader.Load(archive)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"name": "demo-2", "replicas": float64(2)}, baked.Values)
+	for _, f := range baked.Raw {
+		assert.False(t, strings.HasPrefix(f.Name, "vivs/") || f.Name == SettingsFile, f.Name)
+	}
+	assert.Equal(t, 2, len(values["Values"].(map[string]interface{})))
+}
+
+func TestManifestPatches(t *testing.T) {
+	c := &chart.Chart{
+		Metadata: &chart.Metadata{Name: "patched", Version: "0.1.0"},
+		Raw: []*chart.File{
+			{Name: "vivs/values.yaml", Data: []byte("name: base")},
+			{Name: "vivs/patches/web.yaml", Data: []byte(`apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: '{{ .Release.Name }}-web'
+spec:
+  template:
+    spec:
+      containers:
+        - name: web
+          env:
+            - name: REPLICAS
+              value: '{{ .Values.replicas }}'
+---
+target:
+  kind: ConfigMap
+  name: '{{ .Release.Name }}-config'
+patch: |
+  - op: add
+    path: /data/b
+    value: "2"
+`)},
+		},
+	}
+	e := NewEngine(&Config{
+		Values: chartutil.Values{
+			"Values":  map[string]interface{}{"replicas": 3},
+			"Release": map[string]interface{}{"Name": "demo"},
+		},
+		Chart: c,
+	})
+
+	outputs, err := e.render()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(outputs))
+
+	patches, err := e.RenderPatches()
+	assert.Nil(t, err)
+	p, err := NewPostRenderer(patches)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(p.patches))
+	assert.Equal(t, "patched/vivs/patches/web.yaml", p.patches[1].source)
+
+	manifests := `---
+# Source: patched/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: demo-web
+spec:
+  template:
+    spec:
+      containers:
+        - name: web
+          image: nginx
+        - name: sidecar
+          image: busybox
+---
+# Source: patched/templates/cm.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: demo-config
+data:
+  a: "1"
+---
+# Source: patched/templates/service.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: demo
+`
+	out, err := p.Run(bytes.NewBufferString(manifests))
+	assert.Nil(t, err)
+	assert.Contains(t, out.String(), `# Source: patched/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: demo-web
+spec:
+  template:
+    spec:
+      containers:
+      - env:
+        - name: REPLICAS
+          value: "3"
+        image: nginx
+        name: web
+      - image: busybox
+        name: sidecar
+`)
+	assert.Contains(t, out.String(), "data:\n  a: \"1\"\n  b: \"2\"\n")
+	assert.Contains(t, out.String(), "---\n# Source: patched/templates/service.yaml\napiVersion: v1\nkind: Service\n")
+
+	_, err = p.Run(bytes.NewBufferString("apiVersion: v1\nkind: Service\nmetadata:\n  name: demo\n"))
+	assert.ErrorContains(t, err, "matches no resource apps/v1/Deployment demo-web")
+
+	_, err = NewPostRenderer([]byte("kind: Deployment\n"))
+	assert.ErrorContains(t, err, "strategic merge patch needs")
+	// a values viv left in the patches dir
+	_, err = NewPostRenderer([]byte("---\n# Source: patched/vivs/patches/values.yaml\nreplicas: 2\n"))
+	assert.ErrorContains(t, err, "manifest patch: patched/vivs/patches/values.yaml")
+	assert.ErrorContains(t, err, "patched/vivs/patches/ holds manifest patches: move values vivs out of it, or set patchesDir in viv.yaml")
+	_, err = NewPostRenderer([]byte("---\n# Source: patched/vivs/manifests/values.yaml\nreplicas: 2\n"))
+	assert.ErrorContains(t, err, "patched/vivs/manifests/ holds manifest patches")
+}
+
+func TestWorkspaces(t *testing.T) {
+	dir := t.TempDir()
+	c := &chart.Chart{
+		Metadata: &chart.Metadata{Name: "ws", Version: "0.1.0"},
+		Raw:      []*chart.File{{Name: "vivs/values.yaml", Data: []byte("name: '{{ .Release.Name }}'")}},
+	}
+	newEngine := func() *Engine {
+		return NewEngine(&Config{
+			WorkDir: dir,
+			Values:  chartutil.Values{"Values": map[string]interface{}{}, "Release": map[string]interface{}{"Name": "demo"}},
+			Chart:   c,
+		})
+	}
+
+	first, second := newEngine(), newEngine()
+	firstFiles, secondFiles := first.RenderToTemp(), second.RenderToTemp()
+	assert.Equal(t, 1, len(firstFiles))
+	assert.NotEqual(t, path.Dir(firstFiles[0]), path.Dir(secondFiles[0]))
+	assert.True(t, strings.HasPrefix(firstFiles[0], path.Join(dir, "vivTemp", workspacePrefix)))
+
+	// a crashed run leaves its workspace without holding its lock
+	stale := path.Join(dir, "vivTemp", workspacePrefix+"crashed")
+	assert.Nil(t, os.MkdirAll(stale, 0755))
+	assert.Nil(t, os.WriteFile(path.Join(stale, workspaceLock), nil, 0644))
+	old := time.Now().Add(-2 * workspaceGrace)
+	assert.Nil(t, os.Chtimes(stale, old, old))
+	// a run that created its lock file but does not hold it yet
+	starting := path.Join(dir, "vivTemp", workspacePrefix+"starting")
+	assert.Nil(t, os.MkdirAll(starting, 0755))
+	assert.Nil(t, os.WriteFile(path.Join(starting, workspaceLock), nil, 0644))
+
+	first.Clear()
+	_, err := os.Stat(firstFiles[0])
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(secondFiles[0])
+	assert.Nil(t, err)
+
+	removed, err := second.CleanWorkspaces()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{stale}, removed)
+	_, err = os.Stat(secondFiles[0])
+	assert.Nil(t, err)
+	_, err = os.Stat(starting)
+	assert.Nil(t, err)
+
+	assert.Nil(t, os.RemoveAll(starting))
+	second.Clear()
+	_, err = os.Stat(path.Join(dir, "vivTemp"))
+	assert.True(t, os.IsNotExist(err))
+}
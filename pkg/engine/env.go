@@ -0,0 +1,80 @@
+package engine
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// envAccess backs the `env` function of vivs. Only variables matching one of the
+// allowed patterns (path.Match syntax, e.g. "CI_*") can be read, and every
+// variable read is recorded.
+type envAccess struct {
+	allow []string
+
+	mu   sync.Mutex
+	read map[string]bool
+}
+
+func newEnvAccess(allow []string) *envAccess {
+	return &envAccess{
+		allow: allow,
+		read:  map[string]bool{},
+	}
+}
+
+// Getenv returns the value of an allowed environment variable, "" if it is not set
+func (a *envAccess) Getenv(name string) (string, error) {
+	if !a.allowed(name) {
+		return "", errors.Errorf("environment variable %q is not allowed, add it to --viv-env-allow or HELM_VIV_ENV_ALLOW", name)
+	}
+
+	a.record(name)
+	return os.Getenv(name), nil
+}
+
+func (a *envAccess) record(names ...string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, name := range names {
+		a.read[name] = true
+	}
+}
+
+// Allowed returns the allowed variables that are set, as sorted KEY=VALUE pairs
+func (a *envAccess) Allowed() []string {
+	vars := make([]string, 0)
+	for _, kv := range os.Environ() {
+		if name := strings.SplitN(kv, "=", 2)[0]; a.allowed(name) {
+			vars = append(vars, kv)
+		}
+	}
+	sort.Strings(vars)
+	return vars
+}
+
+func (a *envAccess) allowed(name string) bool {
+	for _, pattern := range a.allow {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Read returns the names of the variables read so far, sorted
+func (a *envAccess) Read() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	names := make([]string, 0, len(a.read))
+	for name := range a.read {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,138 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/chart"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// ManifestName is the file that lists the exported values files and the vivs they come from
+	ManifestName = "manifest.yaml"
+	// MergedName is the values file exported when merged
+	MergedName = "values.yaml"
+)
+
+// Manifest describes the values files written by Export
+type Manifest struct {
+	Chart   string         `json:"chart"`
+	Version string         `json:"version"`
+	Files   []ManifestFile `json:"files"`
+}
+
+// ManifestFile is an exported values file, with the viv files it is rendered from
+type ManifestFile struct {
+	Path    string           `json:"path"`
+	SHA256  string           `json:"sha256"`
+	Sources []ManifestSource `json:"sources"`
+}
+
+// ManifestSource is a viv file of the chart
+type ManifestSource struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+// Export renders the vivs and writes the values to dst, for committing them: one values file
+// per chart named after its path in the umbrella chart, or a single values.yaml when merged,
+// and a manifest.yaml. Keys are sorted so that unchanged values give the same files.
+// The files of a chart are merged the way helm merges several -f files.
+func (e *Engine) Export(dst string, merged bool) (*Manifest, error) {
+	outputs, err := e.cachedRender()
+	if err != nil {
+		return nil, err
+	}
+	sources, err := e.eachChart(e.cfg.Chart, "")
+	if err != nil {
+		return nil, errors.Wrap(err, "eachChart failed")
+	}
+	// outputs are named after their viv file, cached outputs may not be in the order of the sources
+	byName := make(map[string]*chart.File, len(outputs))
+	for _, f := range outputs {
+		byName[f.Name] = f
+	}
+
+	files := make([]ManifestFile, 0)
+	values := make([]map[string]interface{}, 0)
+	for _, src := range sources {
+		output, ok := byName[strings.ReplaceAll(src.Name, "/", "_")]
+		if !ok {
+			// skipped by its when condition
+			continue
+		}
+
+		name := MergedName
+		if !merged {
+			name = strings.ReplaceAll(src.chart.ChartFullPath(), "/", "_") + ".yaml"
+		}
+		if len(files) == 0 || files[len(files)-1].Path != name {
+			files = append(files, ManifestFile{Path: name, Sources: make([]ManifestSource, 0)})
+			values = append(values, map[string]interface{}{})
+		}
+
+		current := map[string]interface{}{}
+		if err := yaml.Unmarshal(output.Data, &current); err != nil {
+			return nil, errors.Wrapf(err, "file: %s", src.Name)
+		}
+		last := len(files) - 1
+		mergeValues(values[last], current)
+		files[last].Sources = append(files[last].Sources, ManifestSource{Path: src.Name, SHA256: checksum(sourceData(src))})
+	}
+
+	if err := os.MkdirAll(dst, os.ModePerm); err != nil {
+		return nil, err
+	}
+	for i := range files {
+		data, err := yaml.Marshal(values[i])
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(filepath.Join(dst, files[i].Path), data, 0644); err != nil {
+			return nil, err
+		}
+		files[i].SHA256 = checksum(data)
+	}
+
+	manifest := &Manifest{Chart: e.cfg.Chart.Name(), Version: e.cfg.Chart.Metadata.Version, Files: files}
+	data, err := yaml.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	return manifest, os.WriteFile(filepath.Join(dst, ManifestName), data, 0644)
+}
+
+// sourceData is the data of the viv file in its chart, with its front matter
+func sourceData(f *vivFile) []byte {
+	name := strings.TrimPrefix(f.Name, f.chart.ChartFullPath()+"/")
+	for _, raw := range f.chart.Raw {
+		if raw.Name == name {
+			return raw.Data
+		}
+	}
+	return f.Data
+}
+
+// mergeValues merges src into dst, src wins like a later -f file
+func mergeValues(dst, src map[string]interface{}) {
+	for k, v := range src {
+		if next, ok := asMap(v); ok {
+			if cur, ok := asMap(dst[k]); ok {
+				mergeValues(cur, next)
+				dst[k] = cur
+				continue
+			}
+		}
+		dst[k] = v
+	}
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
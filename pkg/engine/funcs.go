@@ -0,0 +1,160 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// dnsLabelMaxLen is the max length of a DNS-1123 label
+const dnsLabelMaxLen = 63
+
+var dnsInvalidChars = regexp.MustCompile("[^a-z0-9-]+")
+
+// vivFuncs returns the viv helper functions, they are all prefixed with viv
+func vivFuncs() template.FuncMap {
+	return template.FuncMap{
+		"vivDNSName":          vivDNSName,
+		"vivServiceFQDN":      vivServiceFQDN,
+		"vivGet":              vivGet,
+		"vivSubchartFullname": vivSubchartFullname,
+	}
+}
+
+// vivDNSName turns name into a DNS-1123 label of at most maxLen (default 63) characters.
+// Names that are too long are truncated and suffixed with a hash of the full name,
+// so that two long names with the same prefix do not collide.
+// Names without any valid character are an error, not an empty label.
+//
+//	{{ vivDNSName (printf "%s-%s" .Release.Name "worker") }}
+func vivDNSName(name string, maxLen ...int) (string, error) {
+	limit := dnsLabelMaxLen
+	if len(maxLen) > 0 && maxLen[0] > 0 && maxLen[0] < dnsLabelMaxLen {
+		limit = maxLen[0]
+	}
+
+	label := strings.Trim(dnsInvalidChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if label == "" {
+		return "", errors.Errorf("vivDNSName: %q has no valid DNS label character", name)
+	}
+	if len(label) <= limit {
+		return label, nil
+	}
+
+	sum := sha256.Sum256([]byte(name))
+	hash := hex.EncodeToString(sum[:])[:8]
+	if limit <= len(hash) {
+		return hash[:limit], nil
+	}
+	return strings.TrimRight(label[:limit-len(hash)-1], "-") + "-" + hash, nil
+}
+
+// vivServiceFQDN returns the in-cluster FQDN of a service
+//
+//	{{ vivServiceFQDN (include "mychart.fullname" .) .Release.Namespace }}  => release-mychart.default.svc.cluster.local
+func vivServiceFQDN(service, namespace string, clusterDomain ...string) string {
+	domain := "cluster.local"
+	if len(clusterDomain) > 0 && clusterDomain[0] != "" {
+		domain = strings.Trim(clusterDomain[0], ".")
+	}
+	if namespace == "" {
+		namespace = "default"
+	}
+	return fmt.Sprintf("%s.%s.svc.%s", service, namespace, domain)
+}
+
+// vivGet returns the value at a dotted path, def (or nil) if it is missing or null.
+// Numeric segments index lists.
+//
+//	{{ vivGet .Values "ingress.hosts.0.host" "chart-example.local" }}
+func vivGet(obj interface{}, key string, def ...interface{}) interface{} {
+	var fallback interface{}
+	if len(def) > 0 {
+		fallback = def[0]
+	}
+
+	current := obj
+	for _, segment := range strings.Split(key, ".") {
+		if segment == "" {
+			continue
+		}
+		if m, ok := asMap(current); ok {
+			current = m[segment]
+			continue
+		}
+		if l, ok := current.([]interface{}); ok {
+			idx, err := strconv.Atoi(segment)
+			if err != nil || idx < 0 || idx >= len(l) {
+				return fallback
+			}
+			current = l[idx]
+			continue
+		}
+		return fallback
+	}
+
+	if current == nil {
+		return fallback
+	}
+	return current
+}
+
+// vivSubchartFullname returns the fullname of a subchart the way `helm create` computes it,
+// from the subchart's own values (fullnameOverride, nameOverride) and chart name.
+//
+//	{{ vivSubchartFullname . "ingressAlias" }}
+func vivSubchartFullname(ctx interface{}, subchart string) (string, error) {
+	top, ok := asMap(ctx)
+	if !ok {
+		return "", errors.New("vivSubchartFullname needs the template context, e.g. vivSubchartFullname . \"subchart\"")
+	}
+
+	subcharts, _ := asMap(top["Subcharts"])
+	sub, ok := asMap(subcharts[subchart])
+	if !ok {
+		return "", errors.Errorf("vivSubchartFullname: %q is not a subchart", subchart)
+	}
+	values, _ := asMap(sub["Values"])
+	release, _ := asMap(top["Release"])
+	releaseName := fmt.Sprint(vivGet(release, "Name", ""))
+
+	if override := fmt.Sprint(vivGet(values, "fullnameOverride", "")); override != "" {
+		return truncName(override), nil
+	}
+
+	name := fmt.Sprint(vivGet(values, "nameOverride", ""))
+	if name == "" {
+		name = chartName(sub["Chart"])
+	}
+	if strings.Contains(releaseName, name) {
+		return truncName(releaseName), nil
+	}
+	return truncName(fmt.Sprintf("%s-%s", releaseName, name)), nil
+}
+
+// chartName reads the Name of the chart metadata of the template context
+func chartName(meta interface{}) string {
+	v := reflect.Indirect(reflect.ValueOf(meta))
+	if v.Kind() != reflect.Struct {
+		return ""
+	}
+	if name := v.FieldByName("Name"); name.IsValid() && name.Kind() == reflect.String {
+		return name.String()
+	}
+	return ""
+}
+
+// truncName is `trunc 63 | trimSuffix "-"`
+func truncName(name string) string {
+	if len(name) > dnsLabelMaxLen {
+		name = name[:dnsLabelMaxLen]
+	}
+	return strings.TrimSuffix(name, "-")
+}
@@ -0,0 +1,128 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mitchellh/copystructure"
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/releaseutil"
+	"sigs.k8s.io/yaml"
+)
+
+// LookupFixtures serves `lookup` from Kubernetes objects read from YAML files,
+// to render vivs that depend on existing resources without a cluster.
+type LookupFixtures struct {
+	objects []map[string]interface{}
+}
+
+// LoadLookupFixtures reads the objects of a YAML file, or of every YAML file in a directory.
+// Files can have several documents, and `kind: List` documents are flattened.
+func LoadLookupFixtures(location string) (*LookupFixtures, error) {
+	info, err := os.Stat(location)
+	if err != nil {
+		return nil, errors.Wrap(err, "lookup fixtures")
+	}
+
+	files := []string{location}
+	if info.IsDir() {
+		files = make([]string, 0)
+		err := filepath.Walk(location, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if ext := filepath.Ext(p); !info.IsDir() && (ext == ".yaml" || ext == ".yml" || ext == ".json") {
+				files = append(files, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "lookup fixtures")
+		}
+		sort.Strings(files)
+	}
+
+	f := &LookupFixtures{objects: make([]map[string]interface{}, 0)}
+	for _, file := range files {
+		if err := f.load(file); err != nil {
+			return nil, errors.Wrapf(err, "lookup fixtures %s", file)
+		}
+	}
+	return f, nil
+}
+
+func (f *LookupFixtures) load(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	docs := releaseutil.SplitManifests(string(data))
+	keys := make([]string, 0, len(docs))
+	for k := range docs {
+		keys = append(keys, k)
+	}
+	sort.Sort(releaseutil.BySplitManifestsOrder(keys))
+
+	for _, k := range keys {
+		obj := map[string]interface{}{}
+		if err := yaml.Unmarshal([]byte(docs[k]), &obj); err != nil {
+			return err
+		}
+		if items, ok := obj["items"].([]interface{}); ok && strings.HasSuffix(fmt.Sprint(obj["kind"]), "List") {
+			for _, item := range items {
+				if m, ok := asMap(item); ok {
+					f.objects = append(f.objects, m)
+				}
+			}
+			continue
+		}
+		if len(obj) > 0 {
+			f.objects = append(f.objects, obj)
+		}
+	}
+	return nil
+}
+
+// Lookup has the signature of helm's `lookup`. An empty name lists the objects,
+// an empty namespace matches every namespace, and objects without a namespace match every namespace.
+// Missing objects are empty maps. It returns copies, that vivs can change.
+func (f *LookupFixtures) Lookup(apiVersion, kind, namespace, name string) (map[string]interface{}, error) {
+	items := make([]interface{}, 0)
+	for _, obj := range f.objects {
+		if obj["apiVersion"] != apiVersion || obj["kind"] != kind {
+			continue
+		}
+		if ns := vivGet(obj, "metadata.namespace", ""); namespace != "" && ns != "" && ns != namespace {
+			continue
+		}
+		if name == "" {
+			items = append(items, obj)
+			continue
+		}
+		if vivGet(obj, "metadata.name", "") == name {
+			return copyObject(obj)
+		}
+	}
+
+	if name != "" {
+		return map[string]interface{}{}, nil
+	}
+	return copyObject(map[string]interface{}{
+		"apiVersion": apiVersion,
+		"kind":       kind + "List",
+		"metadata":   map[string]interface{}{},
+		"items":      items,
+	})
+}
+
+func copyObject(obj map[string]interface{}) (map[string]interface{}, error) {
+	cp, err := copystructure.Copy(obj)
+	if err != nil {
+		return nil, errors.Wrap(err, "lookup fixtures")
+	}
+	return cp.(map[string]interface{}), nil
+}
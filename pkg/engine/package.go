@@ -0,0 +1,121 @@
+package engine
+
+import (
+	"strings"
+
+	"github.com/mitchellh/copystructure"
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"sigs.k8s.io/yaml"
+)
+
+// Package writes a chart archive to dst with the values rendered by the vivs baked into its values.yaml,
+// for helm users without viv. The values are the final values of the engine with the viv outputs on top,
+// keys removed by the vivs are left out. Viv files and settings are not packaged.
+func (e *Engine) Package(dst string) (string, error) {
+	baked, err := e.BakedValues(true)
+	if err != nil {
+		return "", err
+	}
+	data, err := yaml.Marshal(baked)
+	if err != nil {
+		return "", err
+	}
+
+	// the chart of the engine has been processed for rendering, e.g. without its disabled subcharts
+	ch, err := loader.Load(e.cfg.WorkDir)
+	if err != nil {
+		return "", err
+	}
+	ch.Values = baked
+	ch.Raw = append(withoutFile(ch.Raw, chartutil.ValuesfileName), &chart.File{Name: chartutil.ValuesfileName, Data: data})
+	if err := e.walkCharts(ch, e.stripVivs); err != nil {
+		return "", err
+	}
+
+	return chartutil.Save(ch, dst)
+}
+
+// stripVivs removes the viv files and settings of a chart
+func (e *Engine) stripVivs(ch *chart.Chart) error {
+	settings, err := e.settings(ch)
+	if err != nil {
+		return err
+	}
+	isViv := func(name string) bool {
+		return name == SettingsFile || settings.isVivFile(name) || strings.HasPrefix(name, settings.VivDir+"/")
+	}
+
+	raw := make([]*chart.File, 0, len(ch.Raw))
+	for _, f := range ch.Raw {
+		if !isViv(f.Name) {
+			raw = append(raw, f)
+		}
+	}
+	files := make([]*chart.File, 0, len(ch.Files))
+	for _, f := range ch.Files {
+		if !isViv(f.Name) {
+			files = append(files, f)
+		}
+	}
+	ch.Raw, ch.Files = raw, files
+	delete(ch.Metadata.Annotations, SettingsAnnotation)
+	return nil
+}
+
+func withoutFile(files []*chart.File, name string) []*chart.File {
+	out := make([]*chart.File, 0, len(files))
+	for _, f := range files {
+		if f.Name != name {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// BakedValues returns the values Package bakes into values.yaml. When cached is false, the vivs are
+// rendered again instead of being read from the cache.
+func (e *Engine) BakedValues(cached bool) (map[string]interface{}, error) {
+	render := e.render
+	if cached {
+		render = e.cachedRender
+	}
+	outputs, err := render()
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := e.cfg.Values.Table("Values")
+	if err != nil {
+		return nil, errors.Wrap(err, "values")
+	}
+	copied, err := copystructure.Copy(values)
+	if err != nil {
+		return nil, err
+	}
+	baked := map[string]interface{}(copied.(chartutil.Values))
+	for _, f := range outputs {
+		current := map[string]interface{}{}
+		if err := yaml.Unmarshal(f.Data, &current); err != nil {
+			return nil, errors.Wrapf(err, "file: %s", f.Name)
+		}
+		mergeValues(baked, current)
+	}
+	dropNulls(baked)
+	return baked, nil
+}
+
+// dropNulls removes the keys set to null, like helm does when merging values files
+func dropNulls(values map[string]interface{}) {
+	for k, v := range values {
+		if v == nil {
+			delete(values, k)
+			continue
+		}
+		if m, ok := asMap(v); ok {
+			dropNulls(m)
+		}
+	}
+}
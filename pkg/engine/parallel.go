@@ -0,0 +1,88 @@
+package engine
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/chart"
+
+	"github.com/lazychanger/helm-variable-in-values/pkg/render"
+)
+
+// renderErrors are the errors of several charts rendered concurrently, in chart order
+type renderErrors []error
+
+func (errs renderErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// renderVivs renders the vivs of every chart. With Config.Concurrency above 1, the vivs
+// of each chart are rendered on their own by a pool of workers; the result does not
+// depend on scheduling, and the errors of all charts are returned together.
+func (e *Engine) renderVivs(r render.Engine) (map[string]string, error) {
+	values := e.values()
+	if e.cfg.Concurrency <= 1 {
+		return r.Render(e.cfg.Chart, values, e.vivFiles)
+	}
+
+	// the values are scoped and the templates parsed once, workers only execute the vivs of their chart
+	prepared, err := r.Prepare(e.cfg.Chart, values, e.vivFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	charts := e.chartsWithVivs(e.cfg.Chart)
+	results := make([]map[string]string, len(charts))
+	errs := make([]error, len(charts))
+
+	jobs := make(chan int)
+	wg := sync.WaitGroup{}
+	for w := 0; w < e.cfg.Concurrency && w < len(charts); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i], errs[i] = prepared.Execute(charts[i], e.vivFiles)
+				errs[i] = errors.Wrap(errs[i], charts[i].ChartFullPath())
+			}
+		}()
+	}
+	for i := range charts {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	tmpls := map[string]string{}
+	failed := renderErrors{}
+	for i := range charts {
+		if errs[i] != nil {
+			failed = append(failed, errs[i])
+			continue
+		}
+		for name, data := range results[i] {
+			tmpls[name] = data
+		}
+	}
+	if len(failed) > 0 {
+		return nil, failed
+	}
+	return tmpls, nil
+}
+
+// chartsWithVivs returns ch and its dependencies that have vivs, parents first
+func (e *Engine) chartsWithVivs(ch *chart.Chart) []*chart.Chart {
+	charts := make([]*chart.Chart, 0)
+	if len(e.vivFiles(ch)) > 0 {
+		charts = append(charts, ch)
+	}
+	for _, d := range ch.Dependencies() {
+		charts = append(charts, e.chartsWithVivs(d)...)
+	}
+	return charts
+}
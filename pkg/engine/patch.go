@@ -0,0 +1,84 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"path"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+)
+
+// patchSuffixes mark a viv file as a patch of the chart values.
+// A list is applied as a JSON Patch (RFC 6902), a table as a JSON Merge Patch (RFC 7386).
+var patchSuffixes = []string{".patch.yaml", ".patch.yml", ".jsonpatch"}
+
+// isPatch reports whether the viv file is a patch
+func isPatch(name string) bool {
+	base := path.Base(name)
+	for _, suffix := range patchSuffixes {
+		if strings.HasSuffix(base, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyPatch applies the rendered patch to current and returns, as YAML, the values
+// that turn current into the patched values. Removed keys are written as null.
+func applyPatch(data []byte, current map[string]interface{}) ([]byte, error) {
+	patchJSON, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "patch is not valid YAML")
+	}
+	patchJSON = bytes.TrimSpace(patchJSON)
+	if len(patchJSON) == 0 || string(patchJSON) == "null" {
+		return nil, nil
+	}
+
+	if current == nil {
+		current = map[string]interface{}{}
+	}
+	original, err := json.Marshal(current)
+	if err != nil {
+		return nil, err
+	}
+
+	var patched []byte
+	switch patchJSON[0] {
+	case '[':
+		patched, err = applyJSONPatch(original, patchJSON)
+	case '{':
+		patched, err = jsonpatch.MergePatch(original, patchJSON)
+		err = errors.Wrap(err, "merge patch")
+	default:
+		err = errors.New("patch must be a list of JSON Patch operations or a JSON Merge Patch table")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	diff, err := jsonpatch.CreateMergePatch(original, patched)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.JSONToYAML(diff)
+}
+
+// applyJSONPatch applies the operations one by one, so that errors name the failing operation
+func applyJSONPatch(doc, patchJSON []byte) ([]byte, error) {
+	patch, err := jsonpatch.DecodePatch(patchJSON)
+	if err != nil {
+		return nil, errors.Wrap(err, "json patch")
+	}
+
+	for i, op := range patch {
+		p, _ := op.Path()
+		if doc, err = (jsonpatch.Patch{op}).Apply(doc); err != nil {
+			return nil, errors.Wrapf(err, "json patch operation #%d (%s %s)", i, op.Kind(), p)
+		}
+	}
+	return doc, nil
+}
@@ -0,0 +1,316 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/postrender"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/yaml"
+)
+
+// manifestPatchesDir is the default PatchesDir, it holds the patches of the manifests rendered by helm
+const manifestPatchesDir = "patches"
+
+// PatchesName is the file RenderPatchesToTemp writes the rendered manifest patches to
+const PatchesName = "manifest-patches.yaml"
+
+const sourcePrefix = "# Source: "
+
+var documentSep = regexp.MustCompile(`(?m)^---[ \t]*\n?`)
+
+// PatchTarget selects the resources a JSON6902 patch applies to, like the target of a kustomize patch.
+// Empty fields match any resource. Namespaces are only compared when the manifest sets one.
+type PatchTarget struct {
+	Group     string `json:"group,omitempty"`
+	Version   string `json:"version,omitempty"`
+	Kind      string `json:"kind,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// json6902 is a patch document with a target, its patch is a list of operations or a YAML string of them
+type json6902 struct {
+	Target *PatchTarget `json:"target"`
+	Patch  interface{}  `json:"patch"`
+}
+
+// manifestPatch is a patch document of a manifest patch file
+type manifestPatch struct {
+	source string
+	target PatchTarget
+	// operations of a JSON6902 patch, nil for a strategic merge patch
+	operations jsonpatch.Patch
+	// merge is a strategic merge patch, a partial resource
+	merge []byte
+}
+
+// RenderPatches renders the manifest patches of the charts, <VivDir>/<PatchesDir>/*.yaml, with the data of the vivs.
+// Every document is a strategic merge patch, a partial resource with its apiVersion, kind and metadata.name,
+// or a JSON6902 patch with a target and a patch. It returns nil when no chart has patches.
+func (e *Engine) RenderPatches() ([]byte, error) {
+	if err := e.loadSettings(e.cfg.Chart); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0)
+	if err := e.walkCharts(e.cfg.Chart, func(ch *chart.Chart) error {
+		for _, f := range e.patchFiles(ch) {
+			names = append(names, path.Join(ch.ChartFullPath(), f.Name))
+		}
+		return nil
+	}); err != nil || len(names) == 0 {
+		return nil, err
+	}
+
+	root, _ := e.settings(e.cfg.Chart)
+	tmpls, err := e.renderer(root).Render(e.cfg.Chart, e.values(), e.patchFiles)
+	if err != nil {
+		return nil, errors.Wrap(err, "manifest patches render failed")
+	}
+
+	buf := bytes.Buffer{}
+	for _, name := range names {
+		for _, doc := range documentSep.Split(tmpls[name], -1) {
+			if strings.TrimSpace(doc) == "" {
+				continue
+			}
+			fmt.Fprintf(&buf, "---\n%s%s\n%s\n", sourcePrefix, name, strings.TrimRight(doc, "\n"))
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// RenderPatchesToTemp writes the rendered manifest patches to the workspace of RenderToTemp,
+// and returns the file, or "" when no chart has patches
+func (e *Engine) RenderPatchesToTemp() (string, error) {
+	patches, err := e.RenderPatches()
+	if err != nil || patches == nil {
+		return "", err
+	}
+
+	ws, err := e.workspace()
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Join(ws.dir, PatchesName)
+	return name, os.WriteFile(name, patches, 0644)
+}
+
+// patchFiles returns the manifest patches of a chart, sorted by name
+func (e *Engine) patchFiles(ch *chart.Chart) []*chart.File {
+	settings, _ := e.settings(ch)
+	dir := settings.patchesDir()
+
+	files := make([]*chart.File, 0)
+	for _, f := range ch.Raw {
+		if strings.HasPrefix(f.Name, dir) && len(f.Data) > 0 {
+			files = append(files, f)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+	return files
+}
+
+// PostRenderer is a helm post-renderer that applies the rendered manifest patches
+type PostRenderer struct {
+	patches []manifestPatch
+	// Next runs on the patched manifests, e.g. the post-renderer of the user
+	Next postrender.PostRenderer
+}
+
+// NewPostRenderer parses the manifest patches returned by RenderPatches
+func NewPostRenderer(patches []byte) (*PostRenderer, error) {
+	p := &PostRenderer{}
+	for _, doc := range documentSep.Split(string(patches), -1) {
+		source, body := splitSource(doc)
+		if strings.TrimSpace(body) == "" {
+			continue
+		}
+
+		patch, err := parsePatch(source, body)
+		if err != nil {
+			return nil, errors.Wrapf(err, "manifest patch: %s", source)
+		}
+		patch.source = source
+		p.patches = append(p.patches, *patch)
+	}
+	return p, nil
+}
+
+// parsePatch parses a manifest patch rendered from the file source
+func parsePatch(source, body string) (*manifestPatch, error) {
+	doc := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(body), &doc); err != nil {
+		return nil, err
+	}
+
+	if _, ok := doc["target"]; ok {
+		p := json6902{}
+		if err := yaml.UnmarshalStrict([]byte(body), &p); err != nil {
+			return nil, err
+		}
+		ops, err := json.Marshal(p.Patch)
+		if s, ok := p.Patch.(string); ok {
+			ops, err = yaml.YAMLToJSON([]byte(s))
+		}
+		if err != nil {
+			return nil, err
+		}
+		operations, err := jsonpatch.DecodePatch(ops)
+		if err != nil {
+			return nil, errors.Wrap(err, "json patch")
+		}
+		return &manifestPatch{target: *p.Target, operations: operations}, nil
+	}
+
+	target := resourceTarget(doc)
+	if target.Kind == "" || target.Name == "" {
+		// values vivs were rendered from the patches dir before it held manifest patches
+		dir := "the patches dir of the vivs"
+		if source != "" {
+			dir = path.Dir(source) + "/"
+		}
+		return nil, errors.Errorf("a strategic merge patch needs apiVersion, kind and metadata.name, a json6902 patch needs a target. "+
+			"%s holds manifest patches: move values vivs out of it, or set patchesDir in %s", dir, SettingsFile)
+	}
+	merge, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	return &manifestPatch{target: target, merge: merge}, nil
+}
+
+// Run applies the patches to the manifests, in order. A patch that matches no resource is an error.
+func (p *PostRenderer) Run(manifests *bytes.Buffer) (*bytes.Buffer, error) {
+	docs := documentSep.Split(manifests.String(), -1)
+	matched := make([]bool, len(p.patches))
+
+	out := &bytes.Buffer{}
+	for _, doc := range docs {
+		if strings.TrimSpace(doc) == "" {
+			continue
+		}
+		patched, err := p.apply(doc, matched)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(out, "---\n%s\n", strings.TrimRight(patched, "\n"))
+	}
+
+	for i, ok := range matched {
+		if !ok {
+			return nil, errors.Errorf("manifest patch: %s matches no resource %s", p.patches[i].source, p.patches[i].target)
+		}
+	}
+
+	if p.Next != nil {
+		return p.Next.Run(out)
+	}
+	return out, nil
+}
+
+// apply applies the matching patches to a manifest, and returns it unchanged when none matches
+func (p *PostRenderer) apply(doc string, matched []bool) (string, error) {
+	obj := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(doc), &obj); err != nil || len(obj) == 0 {
+		return doc, nil
+	}
+	resource := resourceTarget(obj)
+
+	data, _ := json.Marshal(obj)
+	patched := false
+	for i, patch := range p.patches {
+		if !patch.target.matches(resource) {
+			continue
+		}
+		matched[i], patched = true, true
+
+		var err error
+		if patch.operations != nil {
+			data, err = patch.operations.Apply(data)
+		} else {
+			data, err = strategicMerge(data, patch.merge, resource)
+		}
+		if err != nil {
+			return "", errors.Wrapf(err, "manifest patch: %s, resource %s", patch.source, resource)
+		}
+	}
+	if !patched {
+		return doc, nil
+	}
+
+	body, err := yaml.JSONToYAML(data)
+	if err != nil {
+		return "", err
+	}
+	// keep the # Source: comment of helm
+	comments := make([]string, 0)
+	for _, line := range strings.Split(doc, "\n") {
+		if !strings.HasPrefix(line, "#") {
+			break
+		}
+		comments = append(comments, line)
+	}
+	return strings.Join(append(comments, string(body)), "\n"), nil
+}
+
+// strategicMerge applies a strategic merge patch to the kubernetes types, and a JSON merge patch to the others
+func strategicMerge(data, patch []byte, target PatchTarget) ([]byte, error) {
+	obj, err := scheme.Scheme.New(schema.GroupVersionKind{Group: target.Group, Version: target.Version, Kind: target.Kind})
+	if err != nil {
+		return jsonpatch.MergePatch(data, patch)
+	}
+	return strategicpatch.StrategicMergePatch(data, patch, obj)
+}
+
+// resourceTarget returns the target that selects exactly a resource
+func resourceTarget(obj map[string]interface{}) PatchTarget {
+	apiVersion, _ := obj["apiVersion"].(string)
+	gv, _ := schema.ParseGroupVersion(apiVersion)
+	kind, _ := obj["kind"].(string)
+	metadata, _ := obj["metadata"].(map[string]interface{})
+	name, _ := metadata["name"].(string)
+	namespace, _ := metadata["namespace"].(string)
+	return PatchTarget{Group: gv.Group, Version: gv.Version, Kind: kind, Name: name, Namespace: namespace}
+}
+
+func (t PatchTarget) matches(resource PatchTarget) bool {
+	return (t.Group == "" || t.Group == resource.Group) &&
+		(t.Version == "" || t.Version == resource.Version) &&
+		(t.Kind == "" || t.Kind == resource.Kind) &&
+		(t.Name == "" || t.Name == resource.Name) &&
+		(t.Namespace == "" || resource.Namespace == "" || t.Namespace == resource.Namespace)
+}
+
+func (t PatchTarget) String() string {
+	gvk := schema.GroupVersionKind{Group: t.Group, Version: t.Version, Kind: t.Kind}
+	s := strings.TrimPrefix(fmt.Sprintf("%s/%s", gvk.GroupVersion(), gvk.Kind), "/")
+	if t.Namespace != "" {
+		s += " " + t.Namespace
+	}
+	return s + " " + t.Name
+}
+
+// splitSource returns the source of a patch document written by RenderPatches, and the document
+func splitSource(doc string) (string, string) {
+	if !strings.HasPrefix(doc, sourcePrefix) {
+		return "", doc
+	}
+	line, body, _ := strings.Cut(doc, "\n")
+	return strings.TrimPrefix(line, sourcePrefix), body
+}
@@ -0,0 +1,223 @@
+package engine
+
+import (
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/gobwas/glob"
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/chart"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// SettingsFile is the viv configuration file of a chart
+	SettingsFile = "viv.yaml"
+	// SettingsAnnotation is the Chart.yaml annotation that can hold the viv configuration, as YAML
+	SettingsAnnotation = "viv"
+)
+
+// envOverlayDir holds the environment overlays, relative to the viv dir
+const envOverlayDir = "_env"
+
+const (
+	// PrecedenceViv makes the viv outputs override the user values
+	PrecedenceViv = "viv"
+	// PrecedenceValues makes the viv outputs only fill the user values that are empty
+	PrecedenceValues = "values"
+)
+
+// Settings configure viv for a chart, from its viv.yaml or the viv annotation of its Chart.yaml.
+// Config.Settings overrides them for every chart. OutputDir and Strict are read from the umbrella chart.
+type Settings struct {
+	// VivDir is the directory of the viv files, vivs by default
+	VivDir string `json:"vivDir,omitempty"`
+	// OutputDir is where RenderToTemp writes the outputs, vivTemp by default
+	OutputDir string `json:"outputDir,omitempty"`
+	// Strict makes vivs fail on missing values
+	Strict *bool `json:"strict,omitempty"`
+	// Precedence is viv (default) when the viv outputs override the user values,
+	// values when they only fill the empty ones, like .default.yaml vivs
+	Precedence string `json:"precedence,omitempty"`
+	// Files are glob patterns of the viv files relative to the chart, e.g. vivs/**/*.yaml.
+	// Patterns starting with ! exclude files. All the files under VivDir by default.
+	Files []string `json:"files,omitempty"`
+	// Order lists the viv files, relative to VivDir, that are applied first and in that order.
+	// The other files follow by name.
+	Order []string `json:"order,omitempty"`
+	// PatchesDir is the directory of the manifest patches, relative to VivDir, patches by default
+	PatchesDir string `json:"patchesDir,omitempty"`
+}
+
+var defaultSettings = Settings{VivDir: "vivs", OutputDir: "vivTemp", Precedence: PrecedenceViv, PatchesDir: manifestPatchesDir}
+
+// merge returns s with the fields set in over
+func (s Settings) merge(over Settings) Settings {
+	if over.VivDir != "" {
+		s.VivDir = over.VivDir
+	}
+	if over.OutputDir != "" {
+		s.OutputDir = over.OutputDir
+	}
+	if over.Strict != nil {
+		s.Strict = over.Strict
+	}
+	if over.Precedence != "" {
+		s.Precedence = over.Precedence
+	}
+	if over.Files != nil {
+		s.Files = over.Files
+	}
+	if over.Order != nil {
+		s.Order = over.Order
+	}
+	if over.PatchesDir != "" {
+		s.PatchesDir = over.PatchesDir
+	}
+	return s
+}
+
+func (s Settings) validate() error {
+	if s.VivDir != "" && (path.IsAbs(s.VivDir) || path.Clean(s.VivDir) != s.VivDir || strings.HasPrefix(s.VivDir, "..")) {
+		return errors.Errorf("vivDir: %q must be a clean path inside the chart", s.VivDir)
+	}
+	if s.PatchesDir != "" && (s.PatchesDir == "." || path.IsAbs(s.PatchesDir) || path.Clean(s.PatchesDir) != s.PatchesDir || strings.HasPrefix(s.PatchesDir, "..")) {
+		return errors.Errorf("patchesDir: %q must be a clean path inside the viv dir", s.PatchesDir)
+	}
+	for _, pattern := range s.Files {
+		if _, err := matchGlob(strings.TrimPrefix(pattern, "!"), ""); err != nil {
+			return errors.Wrapf(err, "files: %q", pattern)
+		}
+	}
+	switch s.Precedence {
+	case "", PrecedenceViv, PrecedenceValues:
+	default:
+		return errors.Errorf("precedence: %q must be %s or %s", s.Precedence, PrecedenceViv, PrecedenceValues)
+	}
+	return nil
+}
+
+// isVivFile reports whether a file of the chart is a viv file: under VivDir, or matched by Files
+// and not excluded, and neither a test case, an overlay nor a manifest patch
+func (s Settings) isVivFile(name string) bool {
+	for _, dir := range []string{testsDir, envOverlayDir} {
+		if strings.HasPrefix(name, path.Join(s.VivDir, dir)+"/") {
+			return false
+		}
+	}
+	if strings.HasPrefix(name, s.patchesDir()) {
+		return false
+	}
+	if len(s.Files) == 0 {
+		return strings.HasPrefix(name, s.VivDir+"/")
+	}
+
+	included := false
+	for _, pattern := range s.Files {
+		if ok, _ := matchGlob(strings.TrimPrefix(pattern, "!"), name); !ok {
+			continue
+		}
+		if strings.HasPrefix(pattern, "!") {
+			return false
+		}
+		included = true
+	}
+	return included
+}
+
+// patchesDir returns the directory of the manifest patches, relative to the chart
+func (s Settings) patchesDir() string {
+	return path.Join(s.VivDir, s.PatchesDir) + "/"
+}
+
+// envOverlay returns the directory of the overlay of env
+func (s Settings) envOverlay(env string) string {
+	return path.Join(s.VivDir, envOverlayDir, env) + "/"
+}
+
+// matchGlob matches a path with a glob where ** matches any number of directories, including none
+func matchGlob(pattern, name string) (bool, error) {
+	for _, p := range []string{pattern, strings.ReplaceAll(pattern, "**/", "")} {
+		g, err := glob.Compile(p, '/')
+		if err != nil {
+			return false, err
+		}
+		if g.Match(name) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// strict reports whether Strict is set and true
+func (s Settings) strict() bool {
+	return s.Strict != nil && *s.Strict
+}
+
+// chartSettings caches the settings of the charts
+type chartSettings struct {
+	mu     sync.Mutex
+	charts map[*chart.Chart]Settings
+}
+
+// settings returns the settings of a chart: the defaults, its own settings, then Config.Settings.
+// On error the chart's own settings are skipped.
+func (e *Engine) settings(ch *chart.Chart) (Settings, error) {
+	e.chartSettings.mu.Lock()
+	defer e.chartSettings.mu.Unlock()
+
+	if s, ok := e.chartSettings.charts[ch]; ok {
+		return s, nil
+	}
+	if e.chartSettings.charts == nil {
+		e.chartSettings.charts = map[*chart.Chart]Settings{}
+	}
+
+	own, err := readSettings(ch)
+	if err != nil {
+		return defaultSettings.merge(e.cfg.Settings), errors.Wrapf(err, "viv settings of %s", ch.ChartFullPath())
+	}
+	s := defaultSettings.merge(own).merge(e.cfg.Settings)
+	e.chartSettings.charts[ch] = s
+	return s, nil
+}
+
+// loadSettings reads and validates the settings of the chart and its dependencies
+func (e *Engine) loadSettings(ch *chart.Chart) error {
+	if _, err := e.settings(ch); err != nil {
+		return err
+	}
+	for _, d := range ch.Dependencies() {
+		if err := e.loadSettings(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSettings reads the settings of the chart itself, from viv.yaml or from the viv annotation
+func readSettings(ch *chart.Chart) (Settings, error) {
+	s := Settings{}
+
+	var data []byte
+	for _, f := range ch.Raw {
+		if f.Name == SettingsFile {
+			data = f.Data
+		}
+	}
+	if annotation, ok := ch.Metadata.Annotations[SettingsAnnotation]; ok {
+		if data != nil {
+			return s, errors.Errorf("%s and the %s annotation of Chart.yaml can not be both set", SettingsFile, SettingsAnnotation)
+		}
+		data = []byte(annotation)
+	}
+	if data == nil {
+		return s, nil
+	}
+
+	if err := yaml.UnmarshalStrict(data, &s); err != nil {
+		return s, err
+	}
+	return s, s.validate()
+}
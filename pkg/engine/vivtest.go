@@ -0,0 +1,250 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/lazychanger/helm-variable-in-values/pkg/utils"
+	"github.com/pkg/errors"
+	"github.com/pmezard/go-difflib/difflib"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// testsDir holds the test cases of the vivs of a chart, relative to its viv dir.
+	// They are not vivs themselves.
+	testsDir = "tests"
+	// goldenDir holds the golden files of the test cases, relative to testsDir
+	goldenDir = "golden"
+)
+
+// TestCase is a test of the vivs of a chart, read from vivs/tests/*.yaml (in the viv dir of the chart settings).
+//
+// Without expected values or asserts, the merged values rendered by the vivs are compared
+// with the golden file, vivs/tests/golden/<case>.yaml unless Golden is set.
+type TestCase struct {
+	Release struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+		Upgrade   bool   `json:"upgrade"`
+	} `json:"release"`
+	Capabilities struct {
+		KubeVersion string   `json:"kubeVersion"`
+		APIVersions []string `json:"apiVersions"`
+	} `json:"capabilities"`
+	// Values are the user values, like -f
+	Values map[string]interface{} `json:"values"`
+	// Env selects the environment overlay, like --viv-env
+	Env string `json:"env"`
+	// LookupFixtures serves lookup, relative to vivs/tests
+	LookupFixtures string `json:"lookupFixtures"`
+
+	Expected map[string]interface{} `json:"expected"`
+	Asserts  []TestAssert           `json:"asserts"`
+	Golden   string                 `json:"golden"`
+}
+
+// TestAssert checks the value at a dotted path, Equals unset only checks the path is set
+type TestAssert struct {
+	Path   string      `json:"path"`
+	Equals interface{} `json:"equals"`
+}
+
+// TestOptions are the options of RunTests
+type TestOptions struct {
+	// Update writes the rendered values to the golden files instead of comparing them
+	Update bool
+	// Funcs are added to the functions of the vivs
+	Funcs template.FuncMap
+	// Settings override the viv settings of the charts
+	Settings Settings
+}
+
+// TestResult is the result of a test case
+type TestResult struct {
+	Name     string
+	Failures []string
+	Updated  bool
+}
+
+// Passed reports whether the test case passed
+func (r *TestResult) Passed() bool {
+	return len(r.Failures) == 0
+}
+
+// RunTests runs the test cases of the chart directory offline, in name order.
+// Vivs are rendered in deterministic mode, with the unix epoch as `now`.
+func RunTests(chartDir string, opts TestOptions) ([]*TestResult, error) {
+	ch, err := loader.Load(chartDir)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := NewEngine(&Config{Chart: ch, Settings: opts.Settings}).settings(ch)
+	if err != nil {
+		return nil, err
+	}
+
+	cases, err := filepath.Glob(filepath.Join(chartDir, settings.VivDir, testsDir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(cases)
+
+	results := make([]*TestResult, 0, len(cases))
+	for _, file := range cases {
+		result, err := runTest(chartDir, file, opts)
+		if err != nil {
+			return results, errors.Wrapf(err, "test %s", filepath.Base(file))
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func runTest(chartDir, file string, opts TestOptions) (*TestResult, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	tc := &TestCase{}
+	if err := yaml.UnmarshalStrict(data, tc); err != nil {
+		return nil, err
+	}
+
+	result := &TestResult{Name: strings.TrimSuffix(filepath.Base(file), ".yaml")}
+	actual, err := tc.render(chartDir, filepath.Dir(file), opts)
+	if err != nil {
+		result.Failures = append(result.Failures, err.Error())
+		return result, nil
+	}
+
+	if tc.Expected != nil {
+		result.Failures = append(result.Failures, diffValues(tc.Expected, actual)...)
+	}
+	for _, a := range tc.Asserts {
+		result.Failures = append(result.Failures, a.check(actual)...)
+	}
+	if (tc.Expected != nil || len(tc.Asserts) > 0) && tc.Golden == "" {
+		return result, nil
+	}
+
+	golden := filepath.Join(filepath.Dir(file), utils.IF(tc.Golden == "", filepath.Join(goldenDir, filepath.Base(file)), tc.Golden))
+	if opts.Update {
+		out, err := yaml.Marshal(actual)
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(golden), os.ModePerm)
+		}
+		if err == nil {
+			err = os.WriteFile(golden, out, 0644)
+		}
+		result.Updated = err == nil
+		return result, err
+	}
+
+	data, err = os.ReadFile(golden)
+	if err != nil {
+		result.Failures = append(result.Failures, fmt.Sprintf("no golden file %s, run with --update", golden))
+		return result, nil
+	}
+	expected := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &expected); err != nil {
+		return nil, errors.Wrapf(err, "golden file %s", golden)
+	}
+	result.Failures = append(result.Failures, diffValues(expected, actual)...)
+	return result, nil
+}
+
+// render renders the vivs of the chart with the inputs of the test case, and merges their outputs
+func (tc *TestCase) render(chartDir, dir string, opts TestOptions) (map[string]interface{}, error) {
+	// the chart is loaded for every case, ProcessDependencies removes disabled subcharts
+	ch, err := loader.Load(chartDir)
+	if err != nil {
+		return nil, err
+	}
+	vals := utils.IF(tc.Values == nil, map[string]interface{}{}, tc.Values)
+	if err := chartutil.ProcessDependencies(ch, vals); err != nil {
+		return nil, err
+	}
+
+	caps := chartutil.DefaultCapabilities.Copy()
+	if tc.Capabilities.KubeVersion != "" {
+		kv, err := chartutil.ParseKubeVersion(tc.Capabilities.KubeVersion)
+		if err != nil {
+			return nil, err
+		}
+		caps.KubeVersion = *kv
+	}
+	caps.APIVersions = append(caps.APIVersions, tc.Capabilities.APIVersions...)
+
+	values, err := chartutil.ToRenderValues(ch, vals, chartutil.ReleaseOptions{
+		Name:      utils.IF(tc.Release.Name == "", "release-name", tc.Release.Name),
+		Namespace: utils.IF(tc.Release.Namespace == "", "default", tc.Release.Namespace),
+		Revision:  1,
+		IsInstall: !tc.Release.Upgrade,
+		IsUpgrade: tc.Release.Upgrade,
+	}, caps)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{Values: values, Chart: ch, Funcs: opts.Funcs, Settings: opts.Settings, Env: tc.Env, Deterministic: true, Now: time.Unix(0, 0)}
+	if tc.LookupFixtures != "" {
+		fixtures, err := LoadLookupFixtures(filepath.Join(dir, tc.LookupFixtures))
+		if err != nil {
+			return nil, err
+		}
+		cfg.Lookup = fixtures.Lookup
+	}
+
+	outputs, err := NewEngine(cfg).render()
+	if err != nil {
+		return nil, err
+	}
+	merged := map[string]interface{}{}
+	for _, f := range outputs {
+		current := map[string]interface{}{}
+		if err := yaml.Unmarshal(f.Data, &current); err != nil {
+			return nil, errors.Wrapf(err, "file: %s", f.Name)
+		}
+		mergeValues(merged, current)
+	}
+	return merged, nil
+}
+
+func (a TestAssert) check(actual map[string]interface{}) []string {
+	got := vivGet(actual, a.Path)
+	if a.Equals == nil {
+		if got == nil {
+			return []string{fmt.Sprintf("%s: is not set", a.Path)}
+		}
+		return nil
+	}
+	if diff := diffValues(a.Equals, got); len(diff) > 0 {
+		return []string{fmt.Sprintf("%s:\n%s", a.Path, strings.Join(diff, "\n"))}
+	}
+	return nil
+}
+
+// diffValues returns the unified diff of the YAML of expected and actual, nil if they are equal
+func diffValues(expected, actual interface{}) []string {
+	want, _ := yaml.Marshal(expected)
+	got, _ := yaml.Marshal(actual)
+	if string(want) == string(got) {
+		return nil
+	}
+	diff, _ := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(want)),
+		B:        difflib.SplitLines(string(got)),
+		FromFile: "expected",
+		ToFile:   "actual",
+		Context:  3,
+	})
+	return []string{strings.TrimRight(diff, "\n")}
+}
@@ -0,0 +1,120 @@
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/lazychanger/helm-variable-in-values/pkg/render"
+	"github.com/pkg/errors"
+	"helm.sh/helm/v3/pkg/chart"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	frontMatterDelim = "---\n"
+	// whenSuffix names the templates of the when expressions
+	whenSuffix = ".when"
+)
+
+// frontMatter is the header of a viv file, between --- lines at its top:
+//
+//	---
+//	when: .Values.ingress.tls.enabled
+//	---
+//	ingress: ...
+type frontMatter struct {
+	// When is a template pipeline, the viv file is only rendered when it is true,
+	// e.g. `and .Values.a (semverCompare ">=1.19" .Capabilities.KubeVersion.Version)`
+	When string `json:"when"`
+}
+
+// frontMatterKey matches the keys of a front matter, a first document without them is not one
+var frontMatterKey = regexp.MustCompile(`(?m)^when:`)
+
+// splitFrontMatter returns the front matter of a viv file, and its body with blank lines
+// in place of the front matter, so that template errors keep their line numbers.
+// Files without front matter return nil. The first document is a front matter when it sets `when`.
+func splitFrontMatter(data []byte) (*frontMatter, []byte, error) {
+	if !bytes.HasPrefix(data, []byte(frontMatterDelim)) {
+		return nil, data, nil
+	}
+	end := bytes.Index(data[len(frontMatterDelim):], []byte("\n"+frontMatterDelim))
+	if end < 0 {
+		return nil, data, nil
+	}
+	header := data[len(frontMatterDelim) : len(frontMatterDelim)+end+1]
+	body := data[len(frontMatterDelim)+end+1+len(frontMatterDelim):]
+	// a multi-document viv can start with ---, its first document is not a front matter
+	if !frontMatterKey.Match(header) {
+		return nil, data, nil
+	}
+
+	fm := &frontMatter{}
+	if err := yaml.UnmarshalStrict(header, fm); err != nil {
+		return nil, nil, errors.Wrap(err, "front matter")
+	}
+	blank := bytes.Repeat([]byte("\n"), bytes.Count(header, []byte("\n"))+2)
+	return fm, append(blank, body...), nil
+}
+
+// evalConditions renders the when expressions of the viv files, and skips the files whose
+// expression is false. It renders nothing when no file has one.
+func (e *Engine) evalConditions(r render.Engine) error {
+	e.skipped = map[string]bool{}
+
+	conditions := map[string]string{}
+	if err := e.walkCharts(e.cfg.Chart, func(ch *chart.Chart) error {
+		for _, f := range e.candidateFiles(ch) {
+			fm, _, err := splitFrontMatter(f.Data)
+			if err != nil {
+				return errors.Wrapf(err, "file: %s", path.Join(ch.ChartFullPath(), f.Name))
+			}
+			if fm != nil && strings.TrimSpace(fm.When) != "" {
+				conditions[path.Join(ch.ChartFullPath(), f.Name)] = fm.When
+			}
+		}
+		return nil
+	}); err != nil || len(conditions) == 0 {
+		return err
+	}
+
+	results, err := r.Render(e.cfg.Chart, e.values(), func(ch *chart.Chart) []*chart.File {
+		files := make([]*chart.File, 0)
+		for _, f := range e.candidateFiles(ch) {
+			if when, ok := conditions[path.Join(ch.ChartFullPath(), f.Name)]; ok {
+				files = append(files, &chart.File{
+					Name: f.Name + whenSuffix,
+					Data: []byte(fmt.Sprintf("{{ if %s }}true{{ end }}", when)),
+				})
+			}
+		}
+		return files
+	})
+	if err != nil {
+		return errors.Wrap(err, "when expressions failed")
+	}
+
+	for name, when := range conditions {
+		if strings.TrimSpace(results[name+whenSuffix]) != "true" {
+			e.skipped[name] = true
+			e.log.Debug("skip viv file", "file", name, "when", when)
+		}
+	}
+	return nil
+}
+
+// walkCharts calls fn for the chart and its dependencies, parents first
+func (e *Engine) walkCharts(ch *chart.Chart, fn func(ch *chart.Chart) error) error {
+	if err := fn(ch); err != nil {
+		return err
+	}
+	for _, d := range ch.Dependencies() {
+		if err := e.walkCharts(d, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
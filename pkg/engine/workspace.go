@@ -0,0 +1,141 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gofrs/flock"
+	"github.com/pkg/errors"
+)
+
+const (
+	// workspacePrefix names the workspaces in the output dir
+	workspacePrefix = "run-"
+	// workspaceLock is held by the run of a workspace, until it is removed
+	workspaceLock = ".lock"
+	// workspaceGrace keeps Clean away from the workspaces being created, until their lock is held
+	workspaceGrace = time.Minute
+)
+
+// workspace is the directory of a single run of RenderToTemp, inside the output dir, so that
+// runs on the same chart do not write or remove the files of each other
+type workspace struct {
+	dir  string
+	lock *flock.Flock
+}
+
+// newWorkspace creates a workspace in dir and locks it
+func newWorkspace(dir string) (*workspace, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	ws, err := os.MkdirTemp(dir, workspacePrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	lock := flock.New(filepath.Join(ws, workspaceLock))
+	if ok, err := lock.TryLock(); err != nil || !ok {
+		_ = os.RemoveAll(ws)
+		return nil, errors.Errorf("lock viv workspace %s: %v", ws, err)
+	}
+	return &workspace{dir: ws, lock: lock}, nil
+}
+
+// remove removes the workspace, and the output dir when no other run uses it
+func (w *workspace) remove() {
+	_ = w.lock.Unlock()
+	_ = os.RemoveAll(w.dir)
+	// fails while the output dir has other files
+	_ = os.Remove(filepath.Dir(w.dir))
+}
+
+// workspace returns the workspace of the engine, created in the output dir of the umbrella chart
+func (e *Engine) workspace() (*workspace, error) {
+	if e.ws != nil {
+		return e.ws, nil
+	}
+
+	dir, err := e.outputDir()
+	if err != nil {
+		return nil, err
+	}
+	if e.ws, err = newWorkspace(dir); err != nil {
+		return nil, err
+	}
+	return e.ws, nil
+}
+
+// outputDir returns the output dir of the umbrella chart, relative to WorkDir
+func (e *Engine) outputDir() (string, error) {
+	root, err := e.settings(e.cfg.Chart)
+	if err != nil {
+		return "", err
+	}
+	if filepath.IsAbs(root.OutputDir) {
+		return root.OutputDir, nil
+	}
+	return filepath.Join(e.cfg.WorkDir, root.OutputDir), nil
+}
+
+// CleanWorkspaces removes the workspaces left in the output dir by crashed runs, and returns them
+func (e *Engine) CleanWorkspaces() ([]string, error) {
+	dir, err := e.outputDir()
+	if err != nil {
+		return nil, err
+	}
+	return cleanWorkspaces(dir)
+}
+
+// cleanWorkspaces removes the workspaces in dir whose lock is not held. Workspaces of running commands are kept.
+func cleanWorkspaces(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	removed := make([]string, 0)
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), workspacePrefix) {
+			continue
+		}
+		ws := filepath.Join(dir, entry.Name())
+		if stale, err := isStale(ws); err != nil || !stale {
+			continue
+		}
+		if err := os.RemoveAll(ws); err != nil {
+			return removed, err
+		}
+		removed = append(removed, ws)
+	}
+	// fails while the dir has other files
+	_ = os.Remove(dir)
+	return removed, nil
+}
+
+// isStale reports whether no run holds the lock of the workspace. Workspaces younger than workspaceGrace
+// are never stale, their run may not hold the lock yet.
+func isStale(ws string) (bool, error) {
+	info, err := os.Stat(ws)
+	if err != nil || time.Since(info.ModTime()) <= workspaceGrace {
+		return false, err
+	}
+
+	lockFile := filepath.Join(ws, workspaceLock)
+	if _, err := os.Stat(lockFile); os.IsNotExist(err) {
+		return true, nil
+	}
+
+	lock := flock.New(lockFile)
+	ok, err := lock.TryLock()
+	if err != nil || !ok {
+		return false, err
+	}
+	_ = lock.Unlock()
+	return true, nil
+}
@@ -0,0 +1,166 @@
+// Package logger is the leveled logger of viv, with text and JSON formats.
+// It writes to stderr, out of the way of the output of helm.
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Level is the minimum level of the messages a logger writes
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{LevelDebug: "debug", LevelInfo: "info", LevelWarn: "warn", LevelError: "error"}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ParseLevel parses debug, info, warn or error
+func ParseLevel(s string) (Level, error) {
+	for level, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return level, nil
+		}
+	}
+	return LevelWarn, errors.Errorf("log level: %q must be debug, info, warn or error", s)
+}
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Redacted replaces the secrets in the messages
+const Redacted = "***"
+
+// sensitive matches the names of secret values
+var sensitive = regexp.MustCompile(`(?i)(password|passwd|secret|token|api[-_]?key|credential|private[-_]?key|auth)`)
+
+// IsSensitive reports whether a flag, a value or a key name holds a secret
+func IsSensitive(name string) bool {
+	return sensitive.MatchString(name)
+}
+
+// Logger writes the messages at its level or above, with key value pairs
+type Logger struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	level  Level
+	format string
+	now    func() time.Time
+}
+
+// New returns a logger of the format, text or json
+func New(out io.Writer, level Level, format string) (*Logger, error) {
+	switch format {
+	case "", FormatText:
+		format = FormatText
+	case FormatJSON:
+	default:
+		return nil, errors.Errorf("log format: %q must be %s or %s", format, FormatText, FormatJSON)
+	}
+	return &Logger{mu: &sync.Mutex{}, out: out, level: level, format: format, now: time.Now}, nil
+}
+
+var std, _ = New(os.Stderr, LevelWarn, FormatText)
+
+// Default returns the logger set with SetDefault, warnings and errors as text by default
+func Default() *Logger {
+	return std
+}
+
+// SetDefault replaces the default logger
+func SetDefault(l *Logger) {
+	std = l
+}
+
+// WithLevel returns a copy of the logger with another level
+func (l *Logger) WithLevel(level Level) *Logger {
+	c := *l
+	c.level = level
+	return &c
+}
+
+// Enabled reports whether the messages of level are written
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.log(LevelInfo, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.log(LevelWarn, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+// Debugf logs a formatted debug message, e.g. the debug log of the helm actions
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	if l.Enabled(LevelDebug) {
+		l.log(LevelDebug, strings.TrimSpace(fmt.Sprintf(format, v...)), nil)
+	}
+}
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	fields := map[string]interface{}{}
+	keys := make([]string, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		key := fmt.Sprint(kv[i])
+		val := kv[i+1]
+		if err, ok := val.(error); ok {
+			val = err.Error()
+		}
+		if IsSensitive(key) {
+			val = Redacted
+		}
+		if _, ok := fields[key]; !ok {
+			keys = append(keys, key)
+		}
+		fields[key] = val
+	}
+
+	var line string
+	if l.format == FormatJSON {
+		fields["time"] = l.now().UTC().Format(time.RFC3339)
+		fields["level"] = level.String()
+		fields["msg"] = msg
+		data, _ := json.Marshal(fields)
+		line = string(data)
+	} else {
+		b := strings.Builder{}
+		fmt.Fprintf(&b, "[%s] %s", level, msg)
+		for _, key := range keys {
+			fmt.Fprintf(&b, " %s=%s", key, quote(fmt.Sprint(fields[key])))
+		}
+		line = b.String()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintln(l.out, line)
+}
+
+// quote quotes the text values with spaces
+func quote(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
@@ -0,0 +1,45 @@
+package logger
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l, err := New(buf, LevelInfo, FormatText)
+	assert.Nil(t, err)
+
+	l.Debug("hidden")
+	l.Info("load viv file", "file", "vivs/values.yaml", "note", "two words")
+	l.Warn("exec", "password", "hunter2", "err", errors.New("failed"))
+	assert.Equal(t, "[info] load viv file file=vivs/values.yaml note=\"two words\"\n[warn] exec password=*** err=failed\n", buf.String())
+
+	buf.Reset()
+	l.WithLevel(LevelDebug).Debugf("CHART PATH: %s\n", "./chart")
+	assert.Equal(t, "[debug] CHART PATH: ./chart\n", buf.String())
+
+	buf.Reset()
+	l, err = New(buf, LevelDebug, FormatJSON)
+	assert.Nil(t, err)
+	l.now = func() time.Time { return time.Unix(0, 0) }
+	l.Debug("viv cache hit", "key", "abc", "apiKey", "k")
+	assert.Equal(t, `{"apiKey":"***","key":"abc","level":"debug","msg":"viv cache hit","time":"1970-01-01T00:00:00Z"}`+"\n", buf.String())
+
+	_, err = New(buf, LevelDebug, "xml")
+	assert.ErrorContains(t, err, `log format: "xml"`)
+
+	level, err := ParseLevel("ERROR")
+	assert.Nil(t, err)
+	assert.Equal(t, LevelError, level)
+	_, err = ParseLevel("verbose")
+	assert.NotNil(t, err)
+
+	assert.True(t, IsSensitive("db.password"))
+	assert.True(t, IsSensitive("kube-token"))
+	assert.False(t, IsSensitive("image.tag"))
+}
@@ -0,0 +1,130 @@
+package render
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// CallSitePrefix starts the call site that the calls of Engine.SiteFuncs get as first argument
+const CallSitePrefix = "\x00site:"
+
+// yamlKey matches a line that starts with a YAML key, or a list item with a key
+var yamlKey = regexp.MustCompile(`^( *)(- +)?([^\s:{}#'"\-][^\s:{}]*|"[^"]*"|'[^']*') *:( |$)`)
+
+// rewriteCallSites adds the call site as first argument to the calls of funcs, in every template of t.
+//
+// The call site is the file, the YAML key path of the line of the call and the call itself, numbered
+// when the same call is made several times under the same key path. It does not change when other
+// lines of the file change.
+func rewriteCallSites(t *template.Template, sources map[string]string, funcs []string) {
+	if len(funcs) == 0 {
+		return
+	}
+	w := &siteWriter{funcs: map[string]bool{}, sources: sources, seen: map[string]int{}}
+	for _, fn := range funcs {
+		w.funcs[fn] = true
+	}
+
+	tmpls := t.Templates()
+	sort.Slice(tmpls, func(i, j int) bool { return tmpls[i].Name() < tmpls[j].Name() })
+	for _, tmpl := range tmpls {
+		if tmpl.Tree == nil || tmpl.Tree.Root == nil {
+			continue
+		}
+		w.file = tmpl.Tree.ParseName
+		w.walk(tmpl.Tree.Root)
+	}
+}
+
+type siteWriter struct {
+	funcs   map[string]bool
+	sources map[string]string
+	// seen counts the calls of each site
+	seen map[string]int
+	// file is the file of the template being walked
+	file string
+}
+
+func (w *siteWriter) walk(node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			w.walk(child)
+		}
+	case *parse.ActionNode:
+		w.walk(n.Pipe)
+	case *parse.IfNode:
+		w.branch(&n.BranchNode)
+	case *parse.RangeNode:
+		w.branch(&n.BranchNode)
+	case *parse.WithNode:
+		w.branch(&n.BranchNode)
+	case *parse.TemplateNode:
+		w.walk(n.Pipe)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			w.walk(cmd)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			w.walk(arg)
+		}
+		if ident, ok := n.Args[0].(*parse.IdentifierNode); ok && w.funcs[ident.Ident] {
+			site := w.site(n)
+			arg := &parse.StringNode{NodeType: parse.NodeString, Pos: n.Pos, Quoted: strconv.Quote(site), Text: site}
+			n.Args = append([]parse.Node{n.Args[0], arg}, n.Args[1:]...)
+		}
+	}
+}
+
+func (w *siteWriter) branch(n *parse.BranchNode) {
+	w.walk(n.Pipe)
+	w.walk(n.List)
+	w.walk(n.ElseList)
+}
+
+func (w *siteWriter) site(n *parse.CommandNode) string {
+	site := w.file + "\x00" + keyPath(w.sources[w.file], int(n.Pos)) + "\x00" + n.String()
+	w.seen[site]++
+	return CallSitePrefix + site + "\x00" + strconv.Itoa(w.seen[site])
+}
+
+// keyPath returns the path of the YAML keys of the line at offset pos of src, e.g. "db.password",
+// from the keys of the lines above with a lower indentation
+func keyPath(src string, pos int) string {
+	if pos > len(src) {
+		return ""
+	}
+	lines := strings.Split(src[:pos], "\n")
+
+	keys := make([]string, 0)
+	// a line without key, e.g. a list item, is under the keys with the same indentation or less
+	current := lines[len(lines)-1]
+	limit := len(current) - len(strings.TrimLeft(current, " ")) + 1
+	for i := len(lines) - 1; i >= 0; i-- {
+		m := yamlKey.FindStringSubmatch(lines[i])
+		if m == nil {
+			continue
+		}
+		indent := len(m[1]) + len(m[2])
+		if indent >= limit && i < len(lines)-1 {
+			continue
+		}
+		keys = append([]string{strings.Trim(m[3], `"'`)}, keys...)
+		if indent == 0 {
+			break
+		}
+		limit = indent
+	}
+	return strings.Join(keys, ".")
+}
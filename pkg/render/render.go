@@ -0,0 +1,519 @@
+/*
+Copyright The Helm Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package render is a fork of helm.sh/helm/v3/pkg/engine.
+//
+// Helm's engine only renders the chart templates with a fixed set of template
+// data and functions. Vivs are rendered next to the chart templates (so that
+// named templates can be included), but only the vivs are executed and they
+// get access to the values of the umbrella chart and their parent chart.
+package render
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/mitchellh/copystructure"
+	"github.com/pkg/errors"
+
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/engine"
+	"k8s.io/client-go/rest"
+
+	"github.com/lazychanger/helm-variable-in-values/pkg/utils"
+)
+
+// FileSelector returns the files of a chart that should be rendered.
+type FileSelector func(c *chart.Chart) []*chart.File
+
+// Engine is an implementation of the Helm rendering implementation for vivs.
+type Engine struct {
+	// If strict is enabled, template rendering will fail if a template references
+	// a value that was not passed in.
+	Strict bool
+	// In LintMode, some 'required' template values may be missing, so don't fail
+	LintMode bool
+	// Funcs are added to the function map, replacing functions with the same name
+	Funcs template.FuncMap
+	// RESTConfig, when set, backs `lookup` with the Kubernetes cluster instead of
+	// returning empty results
+	RESTConfig *rest.Config
+	// TemplateFuncs, when set, returns functions that replace the function map
+	// while the template name is executed
+	TemplateFuncs func(name string) template.FuncMap
+	// SiteFuncs are functions whose calls get their call site as first argument, a string
+	// that starts with CallSitePrefix, e.g. to seed random functions per call
+	SiteFuncs []string
+}
+
+// Render renders the files picked by selector in every chart of chrt.
+//
+// The chart templates are parsed alongside, so that vivs can include named
+// templates, but they are not executed.
+//
+// Values are scoped like they are for Helm templates, and in addition:
+//
+//   - .Root is a read-only copy of the values of the umbrella chart
+//   - .Parent is a read-only copy of the values of the parent chart (nil for the umbrella chart)
+//
+// The returned map is keyed by the path of the file prefixed with the full path
+// of its chart, e.g. "parent/charts/child/vivs/values.yaml".
+func (e Engine) Render(chrt *chart.Chart, values chartutil.Values, selector FileSelector) (map[string]string, error) {
+	tpls, refs, err := allTemplates(chrt, values, selector)
+	if err != nil {
+		return nil, err
+	}
+	return e.renderWithReferences(tpls, refs)
+}
+
+// Prepared is a chart whose values are scoped and whose templates are parsed, so that
+// its files can be executed in several calls to Execute, e.g. concurrently.
+type Prepared struct {
+	e    Engine
+	t    *template.Template
+	tpls map[string]renderable
+	refs map[string]renderable
+}
+
+// Prepare scopes the values and parses the templates of chrt like Render, without executing them.
+func (e Engine) Prepare(chrt *chart.Chart, values chartutil.Values, selector FileSelector) (*Prepared, error) {
+	tpls, refs, err := allTemplates(chrt, values, selector)
+	if err != nil {
+		return nil, err
+	}
+	t, err := e.parse(tpls, refs)
+	if err != nil {
+		return nil, err
+	}
+	return &Prepared{e: e, t: t, tpls: tpls, refs: refs}, nil
+}
+
+// Execute renders the selected files of the chart c, keyed like Render. It is safe to call
+// Execute concurrently for different charts, files of the same chart share their values.
+func (p *Prepared) Execute(c *chart.Chart, selector FileSelector) (map[string]string, error) {
+	keys := make([]string, 0)
+	for _, f := range selector(c) {
+		name := path.Join(c.ChartFullPath(), f.Name)
+		if _, ok := p.tpls[name]; !ok {
+			return nil, errors.Errorf("%s has not been prepared", name)
+		}
+		keys = append(keys, name)
+	}
+
+	// the clone has its own function map, include and tpl are bound to it
+	t, err := p.t.Clone()
+	if err != nil {
+		return nil, err
+	}
+	p.e.initFunMap(t, p.refs)
+	return p.e.execute(t, p.tpls, keys)
+}
+
+// Render renders the files picked by selector using the default options.
+func Render(chrt *chart.Chart, values chartutil.Values, selector FileSelector) (map[string]string, error) {
+	return new(Engine).Render(chrt, values, selector)
+}
+
+// renderable is an object that can be rendered.
+type renderable struct {
+	// tpl is the current template.
+	tpl string
+	// vals are the values to be supplied to the template.
+	vals chartutil.Values
+	// namespace prefix to the templates of the current chart
+	basePath string
+}
+
+const warnStartDelim = "HELM_ERR_START"
+const warnEndDelim = "HELM_ERR_END"
+const recursionMaxNums = 1000
+
+var warnRegex = regexp.MustCompile(warnStartDelim + `((?s).*)` + warnEndDelim)
+
+func warnWrap(warn string) string {
+	return warnStartDelim + warn + warnEndDelim
+}
+
+// initFunMap creates the Engine's FuncMap and adds context-specific functions.
+func (e Engine) initFunMap(t *template.Template, referenceTpls map[string]renderable) {
+	funcMap := utils.FuncMap()
+	for k, v := range e.Funcs {
+		funcMap[k] = v
+	}
+	includedNames := make(map[string]int)
+
+	// Add the 'include' function here so we can close over t.
+	funcMap["include"] = func(name string, data interface{}) (string, error) {
+		var buf strings.Builder
+		if v, ok := includedNames[name]; ok {
+			if v > recursionMaxNums {
+				return "", errors.Wrapf(fmt.Errorf("unable to execute template"), "rendering template has a nested reference name: %s", name)
+			}
+			includedNames[name]++
+		} else {
+			includedNames[name] = 1
+		}
+		err := t.ExecuteTemplate(&buf, name, data)
+		includedNames[name]--
+		return buf.String(), err
+	}
+
+	// Add the 'tpl' function here
+	funcMap["tpl"] = func(tpl string, vals chartutil.Values) (string, error) {
+		basePath, err := vals.PathValue("Template.BasePath")
+		if err != nil {
+			return "", errors.Wrapf(err, "cannot retrieve Template.Basepath from values inside tpl function: %s", tpl)
+		}
+
+		templateName, err := vals.PathValue("Template.Name")
+		if err != nil {
+			return "", errors.Wrapf(err, "cannot retrieve Template.Name from values inside tpl function: %s", tpl)
+		}
+
+		templates := map[string]renderable{
+			templateName.(string): {
+				tpl:      tpl,
+				vals:     vals,
+				basePath: basePath.(string),
+			},
+		}
+
+		result, err := e.renderWithReferences(templates, referenceTpls)
+		if err != nil {
+			return "", errors.Wrapf(err, "error during tpl function execution for %q", tpl)
+		}
+		return result[templateName.(string)], nil
+	}
+
+	// Add the `required` function here so we can use lintMode
+	funcMap["required"] = func(warn string, val interface{}) (interface{}, error) {
+		if val == nil {
+			if e.LintMode {
+				// Don't fail on missing required values when linting
+				log.Printf("[INFO] Missing required value: %s", warn)
+				return "", nil
+			}
+			return val, errors.Errorf(warnWrap(warn))
+		} else if _, ok := val.(string); ok {
+			if val == "" {
+				if e.LintMode {
+					// Don't fail on missing required values when linting
+					log.Printf("[INFO] Missing required value: %s", warn)
+					return "", nil
+				}
+				return val, errors.Errorf(warnWrap(warn))
+			}
+		}
+		return val, nil
+	}
+
+	// Override sprig fail function for linting and wrapping message
+	funcMap["fail"] = func(msg string) (string, error) {
+		if e.LintMode {
+			// Don't fail when linting
+			log.Printf("[INFO] Fail: %s", msg)
+			return "", nil
+		}
+		return "", errors.New(warnWrap(msg))
+	}
+
+	// If we are not linting and have a cluster connection, provide a Kubernetes-backed
+	// implementation.
+	if !e.LintMode && e.RESTConfig != nil {
+		funcMap["lookup"] = engine.NewLookupFunction(e.RESTConfig)
+	}
+
+	t.Funcs(funcMap)
+}
+
+// renderWithReferences takes a map of templates/values to render, and a map of
+// templates which can be referenced within them.
+func (e Engine) renderWithReferences(tpls, referenceTpls map[string]renderable) (map[string]string, error) {
+	t, err := e.parse(tpls, referenceTpls)
+	if err != nil {
+		return map[string]string{}, err
+	}
+	return e.execute(t, tpls, sortTemplates(tpls))
+}
+
+// parse parses the templates to render and the templates which can be referenced within them.
+func (e Engine) parse(tpls, referenceTpls map[string]renderable) (t *template.Template, err error) {
+	// Basically, what we do here is start with an empty parent template and then
+	// build up a list of templates -- one for each file. Once all of the templates
+	// have been parsed, we loop through again and execute every template.
+	//
+	// The idea with this process is to make it possible for more complex templates
+	// to share common blocks, but to make the entire thing feel like a file-based
+	// template engine.
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("rendering template failed: %v", r)
+		}
+	}()
+	t = template.New("gotpl")
+	if e.Strict {
+		t.Option("missingkey=error")
+	} else {
+		// Not that zero will attempt to add default values for types it knows,
+		// but will still emit <no value> for others. We mitigate that later.
+		t.Option("missingkey=zero")
+	}
+
+	e.initFunMap(t, referenceTpls)
+
+	// We want to parse the templates in a predictable order. The order favors
+	// higher-level (in file system) templates over deeply nested templates.
+	keys := sortTemplates(tpls)
+	referenceKeys := sortTemplates(referenceTpls)
+
+	for _, filename := range keys {
+		r := tpls[filename]
+		if _, err := t.New(filename).Parse(r.tpl); err != nil {
+			return nil, cleanupParseError(filename, err)
+		}
+	}
+
+	// Adding the reference templates to the template context
+	// so they can be referenced in the tpl function
+	for _, filename := range referenceKeys {
+		if t.Lookup(filename) == nil {
+			r := referenceTpls[filename]
+			if _, err := t.New(filename).Parse(r.tpl); err != nil {
+				return nil, cleanupParseError(filename, err)
+			}
+		}
+	}
+
+	sources := make(map[string]string, len(referenceTpls)+len(tpls))
+	for filename, r := range referenceTpls {
+		sources[filename] = r.tpl
+	}
+	for filename, r := range tpls {
+		sources[filename] = r.tpl
+	}
+	rewriteCallSites(t, sources, e.SiteFuncs)
+	return t, nil
+}
+
+// execute executes the parsed templates named keys, in order.
+func (e Engine) execute(t *template.Template, tpls map[string]renderable, keys []string) (rendered map[string]string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("rendering template failed: %v", r)
+		}
+	}()
+
+	rendered = make(map[string]string, len(keys))
+	for _, filename := range keys {
+		// Don't render partials. We don't care out the direct output of partials.
+		// They are only included from other templates.
+		if strings.HasPrefix(path.Base(filename), "_") {
+			continue
+		}
+		// At render time, add information about the template that is being rendered.
+		vals := tpls[filename].vals
+		vals["Template"] = chartutil.Values{"Name": filename, "BasePath": tpls[filename].basePath}
+		if e.TemplateFuncs != nil {
+			t.Funcs(e.TemplateFuncs(filename))
+		}
+		var buf strings.Builder
+		if err := t.ExecuteTemplate(&buf, filename, vals); err != nil {
+			return map[string]string{}, cleanupExecError(filename, err)
+		}
+
+		// Work around the issue where Go will emit "<no value>" even if Options(missing=zero)
+		// is set. Since missing=error will never get here, we do not need to handle
+		// the Strict case.
+		rendered[filename] = strings.ReplaceAll(buf.String(), "<no value>", "")
+	}
+
+	return rendered, nil
+}
+
+func cleanupParseError(filename string, err error) error {
+	tokens := strings.Split(err.Error(), ": ")
+	if len(tokens) == 1 {
+		// This might happen if a non-templating error occurs
+		return fmt.Errorf("parse error in (%s): %s", filename, err)
+	}
+	// The first token is "template"
+	// The second token is either "filename:lineno" or "filename:lineNo:columnNo"
+	location := tokens[1]
+	// The remaining tokens make up a stacktrace-like chain, ending with the relevant error
+	errMsg := tokens[len(tokens)-1]
+	return fmt.Errorf("parse error at (%s): %s", string(location), errMsg)
+}
+
+func cleanupExecError(filename string, err error) error {
+	if _, isExecError := err.(template.ExecError); !isExecError {
+		return err
+	}
+
+	tokens := strings.SplitN(err.Error(), ": ", 3)
+	if len(tokens) != 3 {
+		// This might happen if a non-templating error occurs
+		return fmt.Errorf("execution error in (%s): %s", filename, err)
+	}
+
+	// The first token is "template"
+	// The second token is either "filename:lineno" or "filename:lineNo:columnNo"
+	location := tokens[1]
+
+	parts := warnRegex.FindStringSubmatch(tokens[2])
+	if len(parts) >= 2 {
+		return fmt.Errorf("execution error at (%s): %s", string(location), parts[1])
+	}
+
+	return err
+}
+
+func sortTemplates(tpls map[string]renderable) []string {
+	keys := make([]string, len(tpls))
+	i := 0
+	for key := range tpls {
+		keys[i] = key
+		i++
+	}
+	sort.Sort(sort.Reverse(byPathLen(keys)))
+	return keys
+}
+
+type byPathLen []string
+
+func (p byPathLen) Len() int      { return len(p) }
+func (p byPathLen) Swap(i, j int) { p[j], p[i] = p[i], p[j] }
+func (p byPathLen) Less(i, j int) bool {
+	a, b := p[i], p[j]
+	ca, cb := strings.Count(a, "/"), strings.Count(b, "/")
+	if ca == cb {
+		return strings.Compare(a, b) == -1
+	}
+	return ca < cb
+}
+
+// allTemplates returns the selected files to render and all templates that can be
+// referenced from them, for a chart and its dependencies.
+//
+// As it goes, it also prepares the values in a scope-sensitive manner.
+func allTemplates(c *chart.Chart, vals chartutil.Values, selector FileSelector) (map[string]renderable, map[string]renderable, error) {
+	tpls := make(map[string]renderable)
+	refs := make(map[string]renderable)
+	if _, err := recAllTpls(c, tpls, refs, vals, vals["Values"], nil, selector); err != nil {
+		return nil, nil, err
+	}
+	return tpls, refs, nil
+}
+
+// recAllTpls recurses through the templates in a chart.
+//
+// As it recurses, it also sets the values to be appropriate for the template
+// scope.
+func recAllTpls(c *chart.Chart, tpls, refs map[string]renderable, vals chartutil.Values, root, parent interface{}, selector FileSelector) (map[string]interface{}, error) {
+	subCharts := make(map[string]interface{})
+	chartMetaData := struct {
+		chart.Metadata
+		IsRoot bool
+	}{*c.Metadata, c.IsRoot()}
+
+	next := map[string]interface{}{
+		"Chart":        chartMetaData,
+		"Files":        newFiles(c.Files),
+		"Release":      vals["Release"],
+		"Capabilities": vals["Capabilities"],
+		"Viv":          vals["Viv"],
+		"Values":       make(chartutil.Values),
+		"Subcharts":    subCharts,
+	}
+
+	// If there is a {{.Values.ThisChart}} in the parent metadata,
+	// copy that into the {{.Values}} for this template.
+	if c.IsRoot() {
+		next["Values"] = vals["Values"]
+	} else if vs, err := vals.Table("Values." + c.Name()); err == nil {
+		next["Values"] = vs
+	}
+
+	var err error
+	if next["Root"], err = readOnly(root); err != nil {
+		return nil, err
+	}
+	if next["Parent"], err = readOnly(parent); err != nil {
+		return nil, err
+	}
+
+	for _, child := range c.Dependencies() {
+		if subCharts[child.Name()], err = recAllTpls(child, tpls, refs, next, root, next["Values"], selector); err != nil {
+			return nil, err
+		}
+	}
+
+	newParentID := c.ChartFullPath()
+	for _, t := range c.Templates {
+		if !isTemplateValid(c, t.Name) {
+			continue
+		}
+		refs[path.Join(newParentID, t.Name)] = renderable{
+			tpl:      string(t.Data),
+			vals:     next,
+			basePath: path.Join(newParentID, "templates"),
+		}
+	}
+
+	for _, f := range selector(c) {
+		r := renderable{
+			tpl:      string(f.Data),
+			vals:     next,
+			basePath: path.Join(newParentID, path.Dir(f.Name)),
+		}
+		tpls[path.Join(newParentID, f.Name)] = r
+		refs[path.Join(newParentID, f.Name)] = r
+	}
+
+	return next, nil
+}
+
+// readOnly returns a deep copy of values, so that functions like `set` cannot
+// change the values seen by other charts.
+func readOnly(values interface{}) (interface{}, error) {
+	if values == nil {
+		return nil, nil
+	}
+	cp, err := copystructure.Copy(values)
+	if err != nil {
+		return nil, errors.Wrap(err, "copy values")
+	}
+	return cp, nil
+}
+
+// isTemplateValid returns true if the template is valid for the chart type
+func isTemplateValid(ch *chart.Chart, templateName string) bool {
+	if isLibraryChart(ch) {
+		return strings.HasPrefix(filepath.Base(templateName), "_")
+	}
+	return true
+}
+
+// isLibraryChart returns true if the chart is a library chart
+func isLibraryChart(c *chart.Chart) bool {
+	return strings.EqualFold(c.Metadata.Type, "library")
+}
@@ -0,0 +1,119 @@
+package render
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+)
+
+func TestRenderScopes(t *testing.T) {
+	child := &chart.Chart{
+		Metadata: &chart.Metadata{Name: "child", Version: "0.1.0"},
+		Raw: []*chart.File{
+			{Name: "vivs/values.yaml", Data: []byte(`name: {{ .Values.name }}-{{ .Parent.serviceName }}-{{ .Root.serviceName }}{{ set .Root "serviceName" "changed" | and "" }}`)},
+		},
+	}
+	parent := &chart.Chart{
+		Metadata: &chart.Metadata{Name: "parent", Version: "0.1.0"},
+		Templates: []*chart.File{
+			{Name: "templates/_helpers.tpl", Data: []byte(`{{ define "parent.name" }}{{ .Chart.Name }}{{ end }}`)},
+			{Name: "templates/deployment.yaml", Data: []byte(`{{ required "not rendered" .Values.missing }}`)},
+		},
+		Raw: []*chart.File{
+			{Name: "vivs/values.yaml", Data: []byte(`name: {{ include "parent.name" . }}-{{ .Root.serviceName }}-{{ .Parent }}`)},
+			{Name: "values.yaml", Data: []byte(`{{ fail "not rendered" }}`)},
+		},
+	}
+	parent.AddDependency(child)
+
+	vals := chartutil.Values{
+		"Values": chartutil.Values{
+			"serviceName": "svc",
+			"child":       map[string]interface{}{"name": "child"},
+		},
+	}
+
+	out, err := Render(parent, vals, func(c *chart.Chart) []*chart.File {
+		files := make([]*chart.File, 0)
+		for _, f := range c.Raw {
+			if f.Name == "vivs/values.yaml" {
+				files = append(files, f)
+			}
+		}
+		return files
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"parent/vivs/values.yaml":              "name: parent-svc-",
+		"parent/charts/child/vivs/values.yaml": "name: child-svc-svc",
+	}, out)
+	assert.Equal(t, "svc", vals["Values"].(chartutil.Values)["serviceName"])
+}
+
+func TestRenderFuncs(t *testing.T) {
+	c := &chart.Chart{
+		Metadata: &chart.Metadata{Name: "funcs", Version: "0.1.0"},
+		Raw: []*chart.File{
+			{Name: "vivs/values.yaml", Data: []byte(`name: {{ hello .Release.Name }}-{{ "x" | upper }}`)},
+		},
+	}
+
+	out, err := Engine{Funcs: map[string]interface{}{
+		"hello": func(s string) string { return "hello-" + s },
+		"upper": func(s string) string { return "upper" },
+	}}.Render(c, chartutil.Values{"Release": map[string]interface{}{"Name": "rel"}}, func(c *chart.Chart) []*chart.File {
+		return c.Raw
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "name: hello-rel-upper", out["funcs/vivs/values.yaml"])
+}
+
+func TestPrepare(t *testing.T) {
+	parent := &chart.Chart{
+		Metadata: &chart.Metadata{Name: "parent", Version: "0.1.0"},
+		Raw:      []*chart.File{{Name: "vivs/values.yaml", Data: []byte(`name: {{ include "parent.name" . }}`)}},
+		Templates: []*chart.File{
+			{Name: "templates/_helpers.tpl", Data: []byte(`{{ define "parent.name" }}{{ .Values.name }}{{ end }}`)},
+		},
+	}
+	child := &chart.Chart{
+		Metadata: &chart.Metadata{Name: "child", Version: "0.1.0"},
+		Raw:      []*chart.File{{Name: "vivs/values.yaml", Data: []byte(`parent: {{ .Parent.name }}`)}},
+	}
+	parent.AddDependency(child)
+
+	p, err := Engine{}.Prepare(parent, chartutil.Values{"Values": map[string]interface{}{"name": "p"}}, func(c *chart.Chart) []*chart.File {
+		return c.Raw
+	})
+	assert.NoError(t, err)
+
+	out, err := p.Execute(child, func(c *chart.Chart) []*chart.File { return c.Raw })
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"parent/charts/child/vivs/values.yaml": "parent: p"}, out)
+
+	out, err = p.Execute(parent, func(c *chart.Chart) []*chart.File { return c.Raw })
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"parent/vivs/values.yaml": "name: p"}, out)
+
+	_, err = p.Execute(parent, func(c *chart.Chart) []*chart.File { return c.Templates })
+	assert.ErrorContains(t, err, "has not been prepared")
+}
+
+func TestKeyPath(t *testing.T) {
+	src := "db:\n  user: {{ x }}\n  password: {{ x }}\nlist:\n  - name: {{ x }}\n  - {{ x }}\ntop: {{ x }}"
+	at := func(n int) int {
+		pos := -1
+		for i := 0; i < n; i++ {
+			pos += strings.Index(src[pos+1:], "{{") + 1
+		}
+		return pos
+	}
+	assert.Equal(t, "db.user", keyPath(src, at(1)))
+	assert.Equal(t, "db.password", keyPath(src, at(2)))
+	assert.Equal(t, "list.name", keyPath(src, at(3)))
+	assert.Equal(t, "list", keyPath(src, at(4)))
+	assert.Equal(t, "top", keyPath(src, at(5)))
+}
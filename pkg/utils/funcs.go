@@ -27,7 +27,7 @@ import (
 	"sigs.k8s.io/yaml"
 )
 
-// funcMap returns a mapping of all of the functions that Engine has.
+// FuncMap returns a mapping of all of the functions that Engine has.
 //
 // Because some functions are late-bound (e.g. contain context-sensitive
 // data), the functions may not all perform identically outside of an Engine
@@ -40,7 +40,7 @@ import (
 //
 // These are late-bound in Engine.Render().  The
 // version included in the FuncMap is a placeholder.
-func funcMap() template.FuncMap {
+func FuncMap() template.FuncMap {
 	f := sprig.TxtFuncMap()
 	delete(f, "env")
 	delete(f, "expandenv")
@@ -48,7 +48,7 @@ func funcMap() template.FuncMap {
 	// Add some extra functionality
 	extra := template.FuncMap{
 		"toToml":        toTOML,
-		"toYaml":        toYAML,
+		"toYaml":        ToYAML,
 		"fromYaml":      fromYAML,
 		"fromYamlArray": fromYAMLArray,
 		"toJson":        toJSON,
@@ -75,11 +75,11 @@ func funcMap() template.FuncMap {
 	return f
 }
 
-// toYAML takes an interface, marshals it to yaml, and returns a string. It will
+// ToYAML takes an interface, marshals it to yaml, and returns a string. It will
 // always return a string, even on marshal error (empty string).
 //
 // This is designed to be called from a template.
-func toYAML(v interface{}) string {
+func ToYAML(v interface{}) string {
 	data, err := yaml.Marshal(v)
 	if err != nil {
 		// Swallow errors inside of a template.
@@ -9,7 +9,7 @@ import (
 func Tmpl(w io.Writer, text string, data interface{}) error {
 	t := template.New("top")
 
-	t.Funcs(funcMap())
+	t.Funcs(FuncMap())
 
 	return template.Must(t.Parse(text)).Execute(w, data)
 }